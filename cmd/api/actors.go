@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/asd/asd/internal/data"
+	"github.com/asd/asd/internal/validator"
 	"net/http"
 )
 
@@ -17,26 +19,69 @@ func (app *application) createActorsHandler(w http.ResponseWriter, r *http.Reque
 	err := app.readJSON(w, r, &input) //non-nil pointer as the target decode destination
 	if err != nil {
 		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	actor := &data.Actor{
+		FirstName:    input.FistName,
+		LastName:     input.LastName,
+		DateOfBirth:  input.DateOfBirth,
+		MoviesCasted: input.MoviesCasted,
+	}
+
+	v := validator.New()
+	if data.ValidateActor(v, actor); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Actors.Insert(actor)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/actors/%d", actor.ID))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"actor": actor}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
 	}
-	// Dump the contents of the input struct in a HTTP response.
-	fmt.Fprintf(w, "%+v\n", input)
 }
 
 func (app *application) showActorsHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
 		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	fields := app.readFields(r.URL.Query(), []string{"id", "firstName", "lastName", "dateOfBirth", "moviesCasted", "version"}, nil)
+	if data.ValidateFields(v, fields); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
 	}
 
-	actor := data.Actor{
-		ID:        id,
-		FirstName: "David",
-		LastName:  "Johnson",
-		//DateOfBirth:  0,
-		MoviesCasted: []string{"Titanic", "Indian Man"},
+	actor, err := app.models.Actors.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	shaped, err := project(actor, fields.Fields)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"actor": actor}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"actor": shaped}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/asd/asd/internal/data"
+	"github.com/asd/asd/internal/validator"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+)
+
+const (
+	// Uploads are read through a multipart form, so they aren't subject to the 1MB
+	// limit that readJSON() puts on JSON bodies.
+	artworkMaxBytes  = 10 << 20
+	artworkMaxMemory = 2 << 20
+	// Images are fully decoded in memory, so the size of the decoded image is capped
+	// as well, to reject small files which decompress into huge images.
+	artworkMaxPixels = 40_000_000
+	artworkQuality   = 88
+)
+
+// An artworkVariant is one of the sizes that uploaded images are stored in. A width of
+// zero keeps the image at its original size.
+type artworkVariant struct {
+	name  string
+	width int
+}
+
+// artworkVariants lists the variants for each kind of artwork, keyed by the URL segment
+// of the upload endpoint.
+var artworkVariants = map[string][]artworkVariant{
+	"poster":   {{"small", 185}, {"medium", 342}, {"large", 780}, {"original", 0}},
+	"backdrop": {{"small", 300}, {"medium", 780}, {"large", 1280}, {"original", 0}},
+}
+
+// The uploadArtworkHandler() returns the handler for "POST /v1/movies/:id/poster" and
+// ".../backdrop". The image is sent as the "image" field of a multipart form, can be
+// a JPEG, PNG or GIF, and is stored as JPEG in each of the variant sizes.
+func (app *application) uploadArtworkHandler(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := app.readIDParam(r)
+		if err != nil {
+			app.notFoundResponse(w, r)
+			return
+		}
+
+		_, err = app.models.Movies.Get(id)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, artworkMaxBytes)
+		err = r.ParseMultipartForm(artworkMaxMemory)
+		if err != nil {
+			if err.Error() == "http: request body too large" {
+				err = fmt.Errorf("body must not be larger than %d bytes", artworkMaxBytes)
+			}
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			app.badRequestResponse(w, r, errors.New("body must contain an \"image\" file field"))
+			return
+		}
+		defer file.Close()
+
+		upload, err := io.ReadAll(file)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// The declared content type of the part is ignored; the format is taken from
+		// the file's contents.
+		v := validator.New()
+		contentType := http.DetectContentType(upload)
+		v.Check(validator.In(contentType, "image/jpeg", "image/png", "image/gif"), "image", "must be a JPEG, PNG or GIF image")
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		config, _, err := image.DecodeConfig(bytes.NewReader(upload))
+		if err != nil {
+			v.AddError("image", "could not be decoded")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+		v.Check(config.Width*config.Height <= artworkMaxPixels, "image", fmt.Sprintf("must not have more than %d pixels", artworkMaxPixels))
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		img, _, err := image.Decode(bytes.NewReader(upload))
+		if err != nil {
+			v.AddError("image", "could not be decoded")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		// The key includes a hash of the upload, so a new image always gets new URLs
+		// and the old ones can be cached forever.
+		sum := sha256.Sum256(upload)
+		artwork := data.Artwork(fmt.Sprintf("%ss/%d/%x", kind, id, sum[:8]))
+
+		urls := make(map[string]string)
+		for _, variant := range artworkVariants[kind] {
+			var buf bytes.Buffer
+			err = jpeg.Encode(&buf, resizeImage(img, variant.width), &jpeg.Options{Quality: artworkQuality})
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			err = app.blobs.Put(string(artwork)+"/"+variant.name+".jpg", &buf)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			urls[variant.name] = artwork.URL(variant.name)
+		}
+
+		old, err := app.models.Movies.SetArtwork(id, kind, artwork)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		// Remove the images that were replaced. A failure here only leaves unused files
+		// behind, so it's logged rather than reported to the client.
+		if old != "" && old != artwork {
+			err = app.blobs.DeletePrefix(string(old))
+			if err != nil {
+				app.logError(r, err)
+			}
+		}
+
+		movie, err := app.models.Movies.Get(id)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie, kind + "_variants": urls}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
+
+// resizeImage() scales img down to the given width, keeping its aspect ratio, by
+// averaging the source pixels that fall into each destination pixel. Transparent
+// areas are flattened onto white, as the result is encoded as JPEG. Images which are
+// already narrow enough (or a width of zero) keep their size.
+func resizeImage(img image.Image, width int) *image.RGBA {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	src := image.NewRGBA(image.Rect(0, 0, srcW, srcH))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Over)
+
+	if width == 0 || srcW <= width {
+		return src
+	}
+	height := srcH * width / srcW
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcH/height, (y+1)*srcH/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcW/width, (x+1)*srcW/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, n int
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(src.Pix[i])
+					g += int(src.Pix[i+1])
+					b += int(src.Pix[i+2])
+					n++
+					i += 4
+				}
+			}
+
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = 0xff
+		}
+	}
+	return dst
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/asd/asd/internal/data"
+	"github.com/asd/asd/internal/validator"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Batches may contain at most this many operations.
+const batchMaxOperations = 50
+
+// batchHeaders are copied from the batch request onto each of its operations. There's
+// no need for Authorization, as the operations share the batch request's context and
+// so its authenticated user.
+var batchHeaders = []string{"Accept-Language"}
+
+// A batchOperation is one request in a batch. Body is sent as the operation's JSON body.
+type batchOperation struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// A batchResult is the response to one operation. JSON responses are embedded as they
+// are, anything else (a CSV export, say) as a string. Operations that weren't run
+// because an earlier one in an atomic batch failed have a 424 Failed Dependency status.
+type batchResult struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// batchExcludedPaths are the endpoints which can't be run as part of a batch, with the
+// reason why. Event streams and exports stream their response for as long as they
+// run, which can't be buffered into a batch result, and imports take a CSV or JSON
+// Lines upload rather than the JSON body an operation is sent with.
+var batchExcludedPaths = []struct {
+	path    string
+	message string
+}{
+	{"/v1/batch", "must not be a batch request"},
+	{"/v1/events", "must not be an event stream"},
+	{"/v1/movies/export", "must not be an export"},
+	{"/v1/movies/import", "must not be an import"},
+}
+
+func validateBatchOperation(v *validator.Validator, i int, op batchOperation) {
+	key := fmt.Sprintf("operations[%d]", i)
+
+	v.Check(validator.In(op.Method, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete), key+".method", "must be GET, POST, PUT, PATCH or DELETE")
+
+	// Check the path the router will see: decoded, so that "/v1/%65vents" is caught,
+	// and cleaned, so that "/v1/movies/../events" is too.
+	u, err := url.Parse(op.Path)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		v.AddError(key+".path", "must be a valid path")
+		return
+	}
+	p := path.Clean(u.Path)
+	v.Check(strings.HasPrefix(p, "/v1/"), key+".path", "must start with /v1/")
+	for _, excluded := range batchExcludedPaths {
+		v.Check(p != excluded.path && !strings.HasPrefix(p, excluded.path+"/"), key+".path", excluded.message)
+	}
+}
+
+// The batchHandler() runs a list of operations through the router in-process, in order,
+// and returns each one's status and body. The whole batch counts as a single request
+// for rate limiting, and each operation is made as the user who sent the batch.
+//
+// Operations are independent by default: a failure doesn't stop the ones after it.
+// With "atomic": true they all run in one database transaction, which is only committed
+// if every operation succeeds. The first failure rolls back everything before it and
+// the rest of the batch isn't run. Event streams, exports and imports aren't allowed
+// in either mode.
+func (app *application) batchHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Operations []batchOperation `json:"operations"`
+		Atomic     bool             `json:"atomic"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.Operations) > 0, "operations", "must contain at least 1 operation")
+	v.Check(len(input.Operations) <= batchMaxOperations, "operations", fmt.Sprintf("must not contain more than %d operations", batchMaxOperations))
+	for i, op := range input.Operations {
+		validateBatchOperation(v, i, op)
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Operations are dispatched to a router of their own. For an atomic batch it
+	// belongs to a copy of the application whose models use the batch transaction.
+	target := app
+	var batch *data.Batch
+	if input.Atomic {
+		batch, err = data.BeginBatch(r.Context(), app.db)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		defer batch.Rollback()
+
+		target = &application{
+			config: app.config,
+			logger: app.logger,
+			db:     app.db,
+			models: batch.Models(),
+			mailer: app.mailer,
+			blobs:  app.blobs,
+			events: app.events,
+		}
+	}
+	router := target.router()
+
+	results := make([]batchResult, len(input.Operations))
+	failed := false
+	for i, op := range input.Operations {
+		if failed {
+			results[i] = batchResult{Status: http.StatusFailedDependency}
+			continue
+		}
+
+		req, err := http.NewRequestWithContext(r.Context(), op.Method, op.Path, bytes.NewReader(op.Body))
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for _, name := range batchHeaders {
+			if value := r.Header.Get(name); value != "" {
+				req.Header.Set(name, value)
+			}
+		}
+		if len(op.Body) > 0 {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		results[i] = batchResult{Status: rec.Code, Body: batchResultBody(rec)}
+		if input.Atomic && rec.Code >= 400 {
+			failed = true
+		}
+	}
+
+	env := envelope{"results": results}
+	if input.Atomic {
+		if !failed {
+			err = batch.Commit()
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+		env["committed"] = !failed
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// batchResultBody() returns an operation's response body for embedding in the batch
+// response.
+func batchResultBody(rec *httptest.ResponseRecorder) json.RawMessage {
+	body := bytes.TrimSpace(rec.Body.Bytes())
+	if len(body) == 0 {
+		return nil
+	}
+	if strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") && json.Valid(body) {
+		return body
+	}
+	js, _ := json.Marshal(rec.Body.String())
+	return js
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/asd/asd/internal/data"
+	"github.com/asd/asd/internal/jsonlog"
+	"github.com/asd/asd/internal/validator"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateBatchOperationPath(t *testing.T) {
+	tests := []struct {
+		path  string
+		valid bool
+	}{
+		{path: "/v1/healthcheck", valid: true},
+		{path: "/v1/movies?page=2&sort=-year", valid: true},
+		{path: "/v1/movies/1/revisions", valid: true},
+		{path: "/v1/batches", valid: true},
+		{path: "/healthcheck", valid: false},
+		{path: "v1/movies", valid: false},
+		{path: "http://example.com/v1/movies", valid: false},
+		{path: "//example.com/v1/movies", valid: false},
+		{path: "/v1/batch", valid: false},
+		{path: "/v1/events", valid: false},
+		{path: "/v1/events?after=10", valid: false},
+		{path: "/v1/%65vents", valid: false},
+		{path: "/v1/movies/../events", valid: false},
+		{path: "/v1//events", valid: false},
+		{path: "/v1/events/", valid: false},
+		{path: "/v1/movies/export", valid: false},
+		{path: "/v1/movies/%65xport?format=csv", valid: false},
+		{path: "/v1/movies/import", valid: false},
+		{path: "/v1/movies/./import", valid: false},
+		{path: "/v1/../v1/batch", valid: false},
+		{path: "/v1/%zz", valid: false},
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+		validateBatchOperation(v, 0, batchOperation{Method: http.MethodGet, Path: tt.path})
+		if v.Valid() != tt.valid {
+			t.Errorf("path %q: valid = %t; want %t (errors: %v)", tt.path, v.Valid(), tt.valid, v.Errors)
+		}
+	}
+}
+
+// batchRequest() sends a batch request as the anonymous user and decodes the response.
+func batchRequest(t *testing.T, app *application, body string) (int, map[string]json.RawMessage) {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/batch", strings.NewReader(body))
+	r = app.contextSetUser(r, data.AnonymousUser)
+	rr := httptest.NewRecorder()
+	app.batchHandler(rr, r)
+
+	var response map[string]json.RawMessage
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", rr.Body.String(), err)
+	}
+	return rr.Code, response
+}
+
+func TestBatchDispatch(t *testing.T) {
+	app := &application{logger: jsonlog.New(io.Discard, jsonlog.LevelOff)}
+	app.config.env = "testing"
+
+	status, response := batchRequest(t, app, `{"operations": [
+		{"method": "GET", "path": "/v1/healthcheck"},
+		{"method": "GET", "path": "/v1/no-such-endpoint"},
+		{"method": "POST", "path": "/v1/movies/1/restore"},
+		{"method": "DELETE", "path": "/v1/healthcheck"}
+	]}`)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d; want %d", status, http.StatusOK)
+	}
+	if _, ok := response["committed"]; ok {
+		t.Error("a non-atomic batch reported whether it was committed")
+	}
+
+	var results []struct {
+		Status int             `json:"status"`
+		Body   json.RawMessage `json:"body"`
+	}
+	err := json.Unmarshal(response["results"], &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every operation runs, even after one fails, and gets its own status. The
+	// restore is made as the batch's (anonymous) user, so it needs authentication.
+	want := []int{http.StatusOK, http.StatusNotFound, http.StatusUnauthorized, http.StatusMethodNotAllowed}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results; want %d", len(results), len(want))
+	}
+	for i, result := range results {
+		if result.Status != want[i] {
+			t.Errorf("results[%d].status = %d; want %d", i, result.Status, want[i])
+		}
+	}
+
+	// JSON responses are embedded as they are.
+	var health struct {
+		Status string `json:"status"`
+	}
+	err = json.Unmarshal(results[0].Body, &health)
+	if err != nil || health.Status != "available" {
+		t.Errorf("results[0].body = %s; want the healthcheck response", results[0].Body)
+	}
+}
+
+func TestBatchRejectsExcludedPaths(t *testing.T) {
+	app := &application{logger: jsonlog.New(io.Discard, jsonlog.LevelOff)}
+
+	for _, path := range []string{"/v1/%65vents", "/v1/movies/export", "/v1/batch"} {
+		status, response := batchRequest(t, app, `{"operations": [
+			{"method": "GET", "path": "/v1/healthcheck"},
+			{"method": "GET", "path": "`+path+`"}
+		]}`)
+		if status != http.StatusUnprocessableEntity {
+			t.Errorf("%s: status = %d; want %d", path, status, http.StatusUnprocessableEntity)
+		}
+		if _, ok := response["results"]; ok {
+			t.Errorf("%s: operations were run", path)
+		}
+	}
+
+	status, _ := batchRequest(t, app, `{"operations": []}`)
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("empty batch: status = %d; want %d", status, http.StatusUnprocessableEntity)
+	}
+}
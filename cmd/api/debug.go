@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/asd/asd/internal/mailer"
+	"net/http"
+)
+
+// The debugMailHandler() lists the messages captured by the in-memory mailer, newest
+// first. It's only routed in development, and with any other mailer backend there's
+// nothing to list.
+func (app *application) debugMailHandler(w http.ResponseWriter, r *http.Request) {
+	memory, ok := app.mailer.Transport().(*mailer.Memory)
+	if !ok {
+		app.errorResponse(w, r, http.StatusNotFound, "captured mail is only available with -mailer=memory")
+		return
+	}
+
+	messages := memory.Messages()
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelope{"messages": messages}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asd/asd/internal/data"
+	"github.com/asd/asd/internal/validator"
+	"net/http"
+)
+
+// errDuplicateMovie stops the transaction of a new movie which looks like an existing
+// one.
+var errDuplicateMovie = errors.New("movie looks like a duplicate")
+
+// duplicateRefs() describes the possible duplicates of a new movie for the client, each
+// with the URL of the existing record.
+func duplicateRefs(movies []*data.Movie) []envelope {
+	refs := make([]envelope, len(movies))
+	for i, movie := range movies {
+		refs[i] = envelope{
+			"id":      movie.ID,
+			"title":   movie.Title,
+			"year":    movie.Year,
+			"runtime": movie.Runtime,
+			"url":     fmt.Sprintf("/v1/movies/%d", movie.ID),
+		}
+	}
+	return refs
+}
+
+// setDuplicateLinks() adds a Link header with rel="duplicate" for each existing record.
+func setDuplicateLinks(headers http.Header, movies []*data.Movie) {
+	for _, movie := range movies {
+		headers.Add("Link", fmt.Sprintf(`</v1/movies/%d>; rel="duplicate"`, movie.ID))
+	}
+}
+
+// The duplicateMovieResponse() method sends a 409 Conflict when a new movie looks like one
+// that already exists, pointing the client at the existing records.
+func (app *application) duplicateMovieResponse(w http.ResponseWriter, r *http.Request, duplicates []*data.Movie) {
+	headers := make(http.Header)
+	setDuplicateLinks(headers, duplicates)
+
+	env := envelope{
+		"error":      "a movie with this title, year and runtime already exists, use ?allow_duplicate=true to create it anyway",
+		"duplicates": duplicateRefs(duplicates),
+	}
+	err := app.writeJSON(w, http.StatusConflict, env, headers)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(500)
+	}
+}
+
+// The listDuplicateMoviesHandler() reports every pair of movies in the catalog which
+// look like the same film, for an admin to review and merge.
+func (app *application) listDuplicateMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// Pairs are always ordered by the older movie, so there is only one sort value.
+	input.Filters.Sort = "id"
+	input.Filters.SortSafelist = []string{"id"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	duplicates, metadata, err := app.models.Movies.GetDuplicates(input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"duplicates": duplicates, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The mergeMoviesHandler() folds the movie in the URL into the one given as "into" in the
+// request body, then moves it to the trash. The response has the surviving movie and
+// counts of what was moved across.
+func (app *application) mergeMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Into int64 `json:"into"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Into > 0, "into", "must be provided")
+	v.Check(input.Into != id, "into", "must be a different movie")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	source, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	target, err := app.models.Movies.Get(input.Into)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("into", "movie does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var merged *data.MergeResult
+	err = app.models.InTransaction(r.Context(), func(models data.Models) error {
+		merged, err = models.Movies.Merge(source, target)
+		if err != nil {
+			return err
+		}
+		return publishEvent(models, data.EventMovieDeleted, envelope{"movie": envelope{"id": source.ID}, "merged_into": target.ID})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Re-read the target for its new rating.
+	movie, err := app.models.Movies.Get(target.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie, "merged": merged}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
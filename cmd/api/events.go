@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asd/asd/internal/data"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// A comment line is sent at least this often, so that proxies don't close an idle
+	// stream and clients notice a dead one.
+	eventHeartbeatInterval = 15 * time.Second
+	// Events are read from the log this many at a time.
+	eventBatchSize = 100
+	// How soon events held back behind a transaction still in progress are looked for
+	// again. No notification comes when that transaction finishes.
+	eventRecheckInterval = time.Second
+	// How often old events are removed from the log.
+	eventSweepInterval = time.Hour
+)
+
+// eventBroker wakes up the open event streams whenever a new event is announced. The
+// streams then read the new events from the log themselves, so a stream that falls
+// behind simply reads more at once.
+type eventBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan struct{}]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: make(map[chan struct{}]struct{})}
+}
+
+func (b *eventBroker) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan struct{}) {
+	b.mu.Lock()
+	delete(b.subscribers, ch)
+	b.mu.Unlock()
+}
+
+// notify() wakes every subscriber. It never blocks: a subscriber that already has a
+// wake-up pending doesn't need another.
+func (b *eventBroker) notify() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// listenForEvents() listens on the Postgres events channel, on a connection of its own,
+// and passes each notification on to the broker. After a reconnect the streams are
+// woken anyway, since notifications sent while disconnected are lost.
+func (app *application) listenForEvents(dsn string) error {
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"listener": data.EventsChannel})
+		}
+		if ev == pq.ListenerEventReconnected {
+			app.events.notify()
+		}
+	})
+	err := listener.Listen(data.EventsChannel)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case <-listener.Notify:
+				app.events.notify()
+			case <-time.After(90 * time.Second):
+				// Check the connection is still alive if it's been quiet for a while.
+				go listener.Ping()
+			}
+		}
+	}()
+	return nil
+}
+
+// startEventSweeper() removes events older than the retention period every hour.
+func (app *application) startEventSweeper(retention time.Duration) {
+	app.runPeriodically(eventSweepInterval, func() {
+		deleted, err := app.models.Events.DeleteOlderThan(retention)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"job": "event sweep"})
+			return
+		}
+		if deleted > 0 {
+			app.logger.PrintInfo("old events removed", map[string]string{"deleted": strconv.FormatInt(deleted, 10)})
+		}
+	})
+}
+
+// readLastEventID() returns the ID of the last event the client has seen, from the
+// Last-Event-ID header an EventSource sends when it reconnects, or the last_event_id
+// query string parameter. With neither, the stream starts from now.
+func (app *application) readLastEventID(r *http.Request) (int64, error) {
+	s := r.Header.Get("Last-Event-ID")
+	if s == "" {
+		s = r.URL.Query().Get("last_event_id")
+	}
+	if s == "" {
+		return app.models.Events.LatestID()
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || id < 0 {
+		return 0, errors.New("Last-Event-ID must be an event id")
+	}
+	return id, nil
+}
+
+// The streamEventsHandler() streams movie and trailer changes as Server-Sent Events. A
+// client that reconnects with Last-Event-ID is first sent every event it missed (as
+// long as they're still in the log). Events the user doesn't have the permission for
+// are skipped.
+//
+// The stream pushes the connection's deadlines forward as it goes, so it isn't cut off
+// by the server's read and write timeouts. On Go versions where that isn't possible
+// the stream ends at the write timeout and the client reconnects and resumes.
+func (app *application) streamEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.serverErrorResponse(w, r, errors.New("response writer does not support streaming"))
+		return
+	}
+
+	lastID, err := app.readLastEventID(r)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Subscribe before reading the backlog, so nothing announced in between is missed.
+	wake := app.events.subscribe()
+	defer app.events.unsubscribe(wake)
+
+	extendDeadlines(w, 2*eventHeartbeatInterval)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		// Send everything after lastID, a batch at a time.
+		for {
+			events, err := app.models.Events.GetAfter(lastID, eventBatchSize)
+			if err != nil {
+				app.logError(r, err)
+				return
+			}
+
+			extendDeadlines(w, 2*eventHeartbeatInterval)
+			for _, event := range events {
+				lastID = event.ID
+				if event.Permission != "" && !permissions.Include(event.Permission) {
+					continue
+				}
+				js, err := json.Marshal(event)
+				if err != nil {
+					app.logError(r, err)
+					return
+				}
+				_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, js)
+				if err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+
+			if len(events) < eventBatchSize {
+				break
+			}
+		}
+
+		var recheck <-chan time.Time
+		held, err := app.models.Events.HeldBackAfter(lastID)
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+		if held {
+			recheck = time.After(eventRecheckInterval)
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-wake:
+		case <-recheck:
+		case <-heartbeat.C:
+			extendDeadlines(w, 2*eventHeartbeatInterval)
+			_, err := fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
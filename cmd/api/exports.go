@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/asd/asd/internal/data"
+	"github.com/asd/asd/internal/validator"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportBatchTimeout is how long the client gets to read each batch of an export. The
+// deadlines are moved on before every batch, so a large export can take as long as it
+// needs while a stalled client is still cut off.
+const exportBatchTimeout = 30 * time.Second
+
+// movieExporter writes batches of movies to the response in one of the export formats.
+// begin() is called before the first batch and end() after the last one.
+type movieExporter interface {
+	begin() error
+	write(movies []*data.Movie) error
+	end() error
+}
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func (e *csvExporter) begin() error {
+	return e.w.Write([]string{"id", "created_at", "title", "year", "runtime", "genres", "version", "average_rating", "rating_count"})
+}
+
+func (e *csvExporter) write(movies []*data.Movie) error {
+	for _, movie := range movies {
+		// Genres are joined with "|" so that the file can be fed straight back into
+		// POST /v1/movies/import.
+		err := e.w.Write([]string{
+			strconv.FormatInt(movie.ID, 10),
+			movie.CreatedAt.Format(time.RFC3339),
+			movie.Title,
+			strconv.FormatInt(int64(movie.Year), 10),
+			strconv.FormatInt(int64(movie.Runtime), 10),
+			strings.Join(movie.Genres, "|"),
+			strconv.FormatInt(int64(movie.Version), 10),
+			strconv.FormatFloat(movie.AverageRating, 'f', -1, 64),
+			strconv.FormatInt(int64(movie.RatingCount), 10),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExporter) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonExporter writes either NDJSON (one movie per line) or a single JSON array,
+// encoding the movies one at a time so nothing is buffered beyond the current batch.
+type jsonExporter struct {
+	w      http.ResponseWriter
+	array  bool
+	second bool
+}
+
+func (e *jsonExporter) begin() error {
+	if e.array {
+		_, err := e.w.Write([]byte("["))
+		return err
+	}
+	return nil
+}
+
+func (e *jsonExporter) write(movies []*data.Movie) error {
+	for _, movie := range movies {
+		js, err := json.Marshal(movie)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !e.array:
+			js = append(js, '\n')
+		case e.second:
+			js = append([]byte(","), js...)
+		}
+		e.second = true
+
+		if _, err = e.w.Write(js); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *jsonExporter) end() error {
+	if e.array {
+		_, err := e.w.Write([]byte("]\n"))
+		return err
+	}
+	return nil
+}
+
+// The exportMoviesHandler() streams the whole (filtered) movies table as a download.
+// Rows are read from a database cursor and flushed to the client batch by batch.
+func (app *application) exportMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.MovieQuery
+		Format string
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+
+	// Exports accept the same filters as GET /v1/movies.
+	input.MovieQuery = app.readMovieQuery(qs, v)
+	input.Format = app.readString(qs, "format", "json")
+
+	v.Check(validator.In(input.Format, "csv", "ndjson", "json"), "format", "must be one of csv, ndjson or json")
+	if data.ValidateMovieQuery(v, input.MovieQuery); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var exporter movieExporter
+	var contentType string
+
+	switch input.Format {
+	case "csv":
+		exporter, contentType = &csvExporter{w: csv.NewWriter(w)}, "text/csv; charset=utf-8"
+	case "ndjson":
+		exporter, contentType = &jsonExporter{w: w}, "application/x-ndjson"
+	default:
+		exporter, contentType = &jsonExporter{w: w, array: true}, "application/json"
+	}
+
+	filename := fmt.Sprintf("movies-%s.%s", time.Now().UTC().Format("20060102"), input.Format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	flusher, _ := w.(http.Flusher)
+	started := false
+
+	extendDeadlines(w, exportBatchTimeout)
+	err := app.models.Movies.Export(r.Context(), input.MovieQuery, func(movies []*data.Movie) error {
+		extendDeadlines(w, exportBatchTimeout)
+		if !started {
+			started = true
+			w.WriteHeader(http.StatusOK)
+			if err := exporter.begin(); err != nil {
+				return err
+			}
+		}
+		if err := exporter.write(movies); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		// Once the first batch has gone out the status code has been sent, so all we
+		// can do is log the error and cut the download short.
+		if started {
+			app.logError(r, err)
+			return
+		}
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// No rows matched, so write an empty (but well-formed) file.
+	if !started {
+		w.WriteHeader(http.StatusOK)
+		if err = exporter.begin(); err != nil {
+			app.logError(r, err)
+			return
+		}
+	}
+	if err = exporter.end(); err != nil {
+		app.logError(r, err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/asd/asd/internal/data"
+	"github.com/asd/asd/internal/validator"
+	"net/url"
+)
+
+// embeddedReviewsLimit is the number of reviews embedded per movie with
+// ?include=reviews. The full list is at GET /v1/movies/:id/reviews.
+const embeddedReviewsLimit = 10
+
+// The readFields() helper reads the ?fields= and ?include= parameters. The caller fills
+// in the safelists and validates the result with data.ValidateFields().
+func (app *application) readFields(qs url.Values, fieldSafelist, includeSafelist []string) data.Fields {
+	return data.Fields{
+		Fields:          app.readCSV(qs, "fields", []string{}),
+		FieldSafelist:   fieldSafelist,
+		Include:         app.readCSV(qs, "include", []string{}),
+		IncludeSafelist: includeSafelist,
+	}
+}
+
+// project() encodes v as a JSON object and keeps only the listed fields, or all of them
+// if fields is empty. Each value keeps the encoding given to it by its struct tags. The
+// map is returned so that related resources can be added to it before it's written.
+func project(v interface{}, fields []string) (map[string]interface{}, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	err = json.Unmarshal(js, &all)
+	if err != nil {
+		return nil, err
+	}
+
+	projected := make(map[string]interface{}, len(all))
+	for key, value := range all {
+		if len(fields) == 0 || validator.In(key, fields...) {
+			projected[key] = value
+		}
+	}
+	return projected, nil
+}
+
+// movieFieldSafelist and movieIncludeSafelist are the values accepted by ?fields= and
+// ?include= on the movie endpoints.
+var (
+	movieFieldSafelist   = []string{"id", "title", "year", "runtime", "genres", "version", "average_rating", "rating_count", "poster_url", "backdrop_url", "original_title", "synopsis", "locale", "relevance"}
+	movieIncludeSafelist = []string{"trailers", "actors", "reviews"}
+)
+
+// shapeMovies() applies ?fields= to the movies and embeds the related resources asked
+// for with ?include=. Each kind of related resource is loaded with one query for all
+// of the movies, however many there are.
+func (app *application) shapeMovies(movies []*data.Movie, f data.Fields) ([]map[string]interface{}, error) {
+	ids := make([]int64, 0, len(movies))
+	titles := make([]string, 0, len(movies))
+	for _, movie := range movies {
+		ids = append(ids, movie.ID)
+		titles = append(titles, castTitle(movie))
+	}
+
+	var (
+		trailers map[int64][]*data.Trailer
+		actors   map[string][]*data.Actor
+		reviews  map[int64][]*data.Review
+		err      error
+	)
+	if f.Includes("trailers") {
+		trailers, err = app.models.Trailers.GetAllForMovies(ids)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if f.Includes("actors") {
+		actors, err = app.models.Actors.GetAllForMovies(titles)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if f.Includes("reviews") {
+		reviews, err = app.models.Reviews.GetLatestForMovies(ids, embeddedReviewsLimit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	shaped := make([]map[string]interface{}, 0, len(movies))
+	for _, movie := range movies {
+		m, err := project(movie, f.Fields)
+		if err != nil {
+			return nil, err
+		}
+		// Movies without any related resources get an empty list rather than null.
+		if trailers != nil {
+			m["trailers"] = append([]*data.Trailer{}, trailers[movie.ID]...)
+		}
+		if actors != nil {
+			m["actors"] = append([]*data.Actor{}, actors[castTitle(movie)]...)
+		}
+		if reviews != nil {
+			m["reviews"] = append([]*data.Review{}, reviews[movie.ID]...)
+		}
+		shaped = append(shaped, m)
+	}
+	return shaped, nil
+}
+
+// castTitle() returns the title which the cast of a movie is recorded under. Actors are
+// linked to movies by their original title, so a translated title mustn't be used.
+func castTitle(movie *data.Movie) string {
+	if movie.OriginalTitle != "" {
+		return movie.OriginalTitle
+	}
+	return movie.Title
+}
@@ -4,12 +4,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/asd/asd/internal/data"
 	"github.com/asd/asd/internal/validator"
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -29,6 +32,99 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// readVersionParam() does the same for the "version" URL parameter used by the movie
+// revision routes.
+func (app *application) readVersionParam(r *http.Request) (int32, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+	version, err := strconv.ParseInt(params.ByName("version"), 10, 32)
+	if err != nil || version < 1 {
+		return 0, errors.New("invalid version parameter")
+	}
+	return int32(version), nil
+}
+
+// readMovieIDParam() reads the "movie_id" URL parameter used by the watchlist entry
+// routes.
+func (app *application) readMovieIDParam(r *http.Request) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.ParseInt(params.ByName("movie_id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid movie_id parameter")
+	}
+	return id, nil
+}
+
+// readDeliveryIDParam() reads the "delivery_id" URL parameter used by the webhook
+// redelivery route.
+func (app *application) readDeliveryIDParam(r *http.Request) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.ParseInt(params.ByName("delivery_id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid delivery_id parameter")
+	}
+	return id, nil
+}
+
+// requestLocales() returns the locales from the Accept-Language header in order of
+// preference, lower-cased, with the plain language added as a fallback after each
+// regional tag ("de-CH" is followed by "de"). Wildcards, invalid tags and tags with
+// q=0 are skipped.
+func requestLocales(r *http.Request) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if !validator.Matches(tag, data.LocaleRX) {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+
+	var locales []string
+	for _, t := range tags {
+		language := strings.SplitN(t.tag, "-", 2)[0]
+		for _, locale := range []string{t.tag, language} {
+			if !validator.In(locale, locales...) {
+				locales = append(locales, locale)
+			}
+		}
+	}
+	return locales
+}
+
+// extendDeadlines() moves the server's read and write deadlines for the current request
+// d into the future, for requests such as file transfers which can legitimately take
+// longer than the server timeouts. The deadline methods are only available on the
+// ResponseWriter from Go 1.20, so on older versions this does nothing and the server
+// timeouts apply.
+func extendDeadlines(w http.ResponseWriter, d time.Duration) {
+	deadline := time.Now().Add(d)
+	if rw, ok := w.(interface{ SetReadDeadline(time.Time) error }); ok {
+		_ = rw.SetReadDeadline(deadline)
+	}
+	if rw, ok := w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		_ = rw.SetWriteDeadline(deadline)
+	}
+}
+
 // in my version of go there is no type as 'any', and instead of it I used interface{},
 // cuz Marshal actually accepts it as a parameter and map is implementing interface.
 // on your side data interface{} must be data any if you are using go version 1.18 or newer
@@ -83,6 +179,9 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
 			}
 			return fmt.Errorf("body contains badly-formed JSON (at character %d)", unmarshalTypeError.Offset)
+		} else if errors.Is(err, data.ErrInvalidRuntimeFormat) {
+			// Returned by data.Runtime, whatever field it's used in.
+			return fmt.Errorf("body contains %v", err)
 		} else if errors.As(err, &invalidUnmarshalError) {
 			panic(err) //If our program reaches a point where it cannot be recovered due to some major errors
 
@@ -114,6 +213,22 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
+// httprouter doesn't allow a static path segment to sit in the same position as a named
+// parameter (so "/v1/movies/trash" and "/v1/movies/:id" can't both be registered). The
+// paramSwitch() helper works around this: the route is registered once with the :id
+// parameter, and if the raw value matches one of the static names we call that handler
+// instead of next.
+func (app *application) paramSwitch(next http.HandlerFunc, static map[string]http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+		if handler, ok := static[params.ByName("id")]; ok {
+			handler(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
 	s := qs.Get(key)
 	if s == "" {
@@ -147,19 +262,76 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
-// The background() helper accepts an arbitrary function as a parameter.
-func (app *application) background(fn func()) {
-	app.wg.Add(1)
-	// Launch a background goroutine.
-	go func() {
-		defer app.wg.Done()
-		// Recover any panic.
+// The readVersion() helper reads a required movie version number from the query
+// string, applying the same range check as readVersionParam().
+func (app *application) readVersion(qs url.Values, key string, v *validator.Validator) int32 {
+	s := qs.Get(key)
+	if s == "" {
+		v.AddError(key, "must be provided")
+		return 0
+	}
+	version, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || version < 1 {
+		v.AddError(key, "must be a positive integer version")
+		return 0
+	}
+	return int32(version)
+}
+
+// The readBool() helper reads a true/false value from the query string. Anything
+// strconv.ParseBool() accepts is allowed ("1", "t", "true" and so on).
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+	return b
+}
+
+// The readTime() helper reads a timestamp from the query string, accepting either a full
+// RFC 3339 value or a plain date (YYYY-MM-DD). As with readInt() a bad value is
+// recorded in the validator and the default is returned.
+func (app *application) readTime(qs url.Values, key string, defaultValue time.Time, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t
+		}
+	}
+	v.AddError(key, "must be a date (YYYY-MM-DD) or an RFC 3339 timestamp")
+	return defaultValue
+}
+
+// The runPeriodically() helper calls fn straight away and then every interval, in a
+// goroutine of its own. Runs never overlap: the next one is only waited for once the
+// current one has finished. A panic is recovered and logged, and doesn't stop later
+// runs.
+func (app *application) runPeriodically(interval time.Duration, fn func()) {
+	run := func() {
 		defer func() {
 			if err := recover(); err != nil {
 				app.logger.PrintError(fmt.Errorf("%s", err), nil)
 			}
 		}()
-		// Execute the arbitrary function that we passed as the parameter.
 		fn()
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			run()
+			<-ticker.C
+		}
 	}()
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRequestLocales(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{header: "", want: nil},
+		{header: "de", want: []string{"de"}},
+		{header: "de-CH", want: []string{"de-ch", "de"}},
+		{header: "de-CH, fr;q=0.9, en;q=0.8", want: []string{"de-ch", "de", "fr", "en"}},
+		// Tags are sorted by weight, keeping the header order for equal weights.
+		{header: "en;q=0.5, pt-BR, fr;q=0.7, es", want: []string{"pt-br", "pt", "es", "fr", "en"}},
+		// A language already listed isn't repeated as a fallback.
+		{header: "de, de-AT;q=0.8", want: []string{"de", "de-at"}},
+		// Wildcards, invalid tags and q=0 are skipped.
+		{header: "*, en-US;q=0, x, fr_FR, it;q=0.3", want: []string{"it"}},
+		// A malformed weight leaves the default of 1.
+		{header: "ja;q=abc, ko;q=0.9", want: []string{"ja", "ko"}},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/v1/movies", nil)
+		if tt.header != "" {
+			r.Header.Set("Accept-Language", tt.header)
+		}
+
+		got := requestLocales(r)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("requestLocales(%q) = %q; want %q", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/asd/asd/internal/data"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Idempotency keys longer than this are rejected.
+	idempotencyKeyMaxLength = 255
+	// Requests with an Idempotency-Key are read into memory to be hashed, so their
+	// bodies are limited to the size of the largest import. Bigger uploads must carry
+	// an X-Checksum-Sha256 header instead (see idempotencyRequestHash()).
+	idempotencyMaxBodyBytes = importMaxBytes
+	// Responses bigger than this aren't stored, so the key is released instead.
+	idempotencyMaxResponseBytes = 1_048_576
+	// How often expired keys are removed.
+	idempotencySweepInterval = time.Hour
+)
+
+// idempotencyRecorder passes a response through to the client while keeping a copy of
+// the status, headers and body for replaying.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+		rec.header = rec.ResponseWriter.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if rec.body.Len()+len(b) > idempotencyMaxResponseBytes {
+			rec.overflow = true
+			rec.body.Reset()
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// SetReadDeadline() and SetWriteDeadline() keep extendDeadlines() working for handlers
+// behind the recorder.
+func (rec *idempotencyRecorder) SetReadDeadline(deadline time.Time) error {
+	if rw, ok := rec.ResponseWriter.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return rw.SetReadDeadline(deadline)
+	}
+	return http.ErrNotSupported
+}
+
+func (rec *idempotencyRecorder) SetWriteDeadline(deadline time.Time) error {
+	if rw, ok := rec.ResponseWriter.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return rw.SetWriteDeadline(deadline)
+	}
+	return http.ErrNotSupported
+}
+
+// idempotencyRequestHash() identifies a request by its method, URL and body, so that a
+// key can't be replayed for a different request.
+func idempotencyRequestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyUploadHash() identifies a request whose body is too big to buffer, such as
+// a trailer file, by its method, URL, length and the SHA-256 the client declared in
+// X-Checksum-Sha256. The body itself is streamed to the handler, which is trusted to
+// reject a body that doesn't match its checksum.
+func idempotencyUploadHash(r *http.Request, checksum string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\ncontent-length: %d\nchecksum: %s\n", r.Method, r.URL.RequestURI(), r.ContentLength, strings.ToLower(checksum))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyScope() returns the scope of the keys sent by the client of a request: the
+// authenticated user, or for anonymous requests the client IP address.
+func idempotencyScope(r *http.Request, user *data.User) string {
+	if !user.IsAnonymous() {
+		return "user:" + strconv.FormatInt(user.ID, 10)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// The idempotent() middleware makes POST requests with an Idempotency-Key header safe to
+// retry. The first request with a key is handled as usual and its response is stored
+// for the configured window; a retry with the same key and the same request gets the
+// stored response back (with an Idempotent-Replayed header) without running the
+// handler again. Reusing a key for a different request is a 409 Conflict, as is a
+// retry that arrives while the first request is still being handled.
+//
+// Keys are scoped to the authenticated user, or to the client IP address for anonymous
+// requests (such as creating a movie without logging in). As the request hash covers
+// the body, a replay to another client behind the same address needs the same key and
+// the exact same request. The header is ignored on the /v1/tokens endpoints, whose
+// responses carry credentials that mustn't be stored. Server errors aren't stored
+// either, so the client can retry them for real.
+func (app *application) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != http.MethodPost || key == "" || strings.HasPrefix(r.URL.Path, "/v1/tokens/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user := app.contextGetUser(r)
+
+		if len(key) > idempotencyKeyMaxLength {
+			app.badRequestResponse(w, r, fmt.Errorf("Idempotency-Key must not be more than %d bytes long", idempotencyKeyMaxLength))
+			return
+		}
+
+		ik := &data.IdempotencyKey{
+			Scope:  idempotencyScope(r, user),
+			UserID: user.ID,
+			Key:    key,
+		}
+
+		// Large uploads with a declared checksum are identified without reading them;
+		// anything else is buffered and hashed.
+		checksum := r.Header.Get("X-Checksum-Sha256")
+		if r.ContentLength > idempotencyMaxBodyBytes && checksum != "" {
+			ik.RequestHash = idempotencyUploadHash(r, checksum)
+		} else {
+			body, err := io.ReadAll(io.LimitReader(r.Body, idempotencyMaxBodyBytes+1))
+			if err != nil {
+				app.badRequestResponse(w, r, err)
+				return
+			}
+			if len(body) > idempotencyMaxBodyBytes {
+				message := fmt.Sprintf("requests with an Idempotency-Key must not be larger than %d bytes, unless they have an X-Checksum-Sha256 header", idempotencyMaxBodyBytes)
+				app.errorResponse(w, r, http.StatusRequestEntityTooLarge, message)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			ik.RequestHash = idempotencyRequestHash(r, body)
+		}
+		requestHash := ik.RequestHash
+
+		claimed, err := app.models.Idempotency.Begin(ik, app.config.idempotency.ttl)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !claimed {
+			switch {
+			case err == nil && ik.RequestHash != requestHash:
+				app.errorResponse(w, r, http.StatusConflict, "Idempotency-Key has already been used for a different request")
+			case err == nil && ik.Status != 0:
+				for name, values := range ik.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(ik.Status)
+				w.Write(ik.Body)
+			default:
+				w.Header().Set("Retry-After", "1")
+				app.errorResponse(w, r, http.StatusConflict, "a request with this Idempotency-Key is still being processed")
+			}
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+
+		// If the handler panics, release the key before recoverPanic() sends the 500,
+		// or retries would be told the request is still being processed until the
+		// key expires.
+		defer func() {
+			if err := recover(); err != nil {
+				app.releaseIdempotencyKey(ik)
+				panic(err)
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+			rec.header = w.Header().Clone()
+		}
+		if rec.status >= 500 || rec.overflow {
+			app.releaseIdempotencyKey(ik)
+			return
+		}
+
+		ik.Status = rec.status
+		ik.Header = rec.header
+		ik.Body = rec.body.Bytes()
+		err = app.models.Idempotency.Complete(ik)
+		if err != nil {
+			app.logError(r, err)
+		}
+	})
+}
+
+// releaseIdempotencyKey() forgets a key after a response that can't be replayed.
+func (app *application) releaseIdempotencyKey(ik *data.IdempotencyKey) {
+	err := app.models.Idempotency.Release(ik.Scope, ik.Key)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"idempotency_key": ik.Key, "scope": ik.Scope})
+	}
+}
+
+// startIdempotencySweeper() removes expired idempotency keys every hour.
+func (app *application) startIdempotencySweeper() {
+	app.runPeriodically(idempotencySweepInterval, func() {
+		deleted, err := app.models.Idempotency.DeleteExpired()
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"job": "idempotency sweep"})
+			return
+		}
+		if deleted > 0 {
+			app.logger.PrintInfo("expired idempotency keys removed", map[string]string{"deleted": strconv.FormatInt(deleted, 10)})
+		}
+	})
+}
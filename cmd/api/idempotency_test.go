@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/asd/asd/internal/data"
+	"github.com/asd/asd/internal/jsonlog"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// idempotencyStore is an in-memory stand-in for the idempotency_keys table. It's
+// reached through a database/sql driver that understands just the queries made by
+// data.IdempotencyModel, so the middleware can be tested without PostgreSQL.
+type idempotencyStore struct {
+	mu   sync.Mutex
+	rows map[string]*idempotencyRow
+}
+
+type idempotencyRow struct {
+	requestHash string
+	status      int64
+	header      []byte
+	body        []byte
+	createdAt   time.Time
+	expiresAt   time.Time
+}
+
+var (
+	idempotencyStores   = map[string]*idempotencyStore{}
+	idempotencyStoresMu sync.Mutex
+)
+
+func init() {
+	sql.Register("idempotencytest", idempotencyDriver{})
+}
+
+type idempotencyDriver struct{}
+
+func (idempotencyDriver) Open(name string) (driver.Conn, error) {
+	idempotencyStoresMu.Lock()
+	defer idempotencyStoresMu.Unlock()
+	return &idempotencyConn{store: idempotencyStores[name]}, nil
+}
+
+type idempotencyConn struct {
+	store *idempotencyStore
+}
+
+func (c *idempotencyConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (c *idempotencyConn) Close() error { return nil }
+
+func (c *idempotencyConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+func (c *idempotencyConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query = strings.TrimSpace(query)
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO idempotency_keys"):
+		id := args[0].Value.(string) + "\x00" + args[2].Value.(string)
+		if row, ok := s.rows[id]; ok && row.expiresAt.After(time.Now()) {
+			return &idempotencyRows{}, nil
+		}
+		row := &idempotencyRow{
+			requestHash: args[3].Value.(string),
+			header:      []byte("{}"),
+			createdAt:   time.Now(),
+			expiresAt:   args[4].Value.(time.Time),
+		}
+		s.rows[id] = row
+		return &idempotencyRows{
+			columns: []string{"created_at", "expires_at"},
+			values:  [][]driver.Value{{row.createdAt, row.expiresAt}},
+		}, nil
+
+	case strings.HasPrefix(query, "SELECT request_hash"):
+		row, ok := s.rows[args[0].Value.(string)+"\x00"+args[1].Value.(string)]
+		if !ok {
+			return &idempotencyRows{}, nil
+		}
+		return &idempotencyRows{
+			columns: []string{"request_hash", "status", "header", "body", "created_at", "expires_at"},
+			values:  [][]driver.Value{{row.requestHash, row.status, row.header, row.body, row.createdAt, row.expiresAt}},
+		}, nil
+	}
+	return nil, errors.New("unexpected query: " + query)
+}
+
+func (c *idempotencyConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	s := c.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query = strings.TrimSpace(query)
+	switch {
+	case strings.HasPrefix(query, "UPDATE idempotency_keys"):
+		row, ok := s.rows[args[3].Value.(string)+"\x00"+args[4].Value.(string)]
+		if !ok {
+			return driver.RowsAffected(0), nil
+		}
+		row.status = args[0].Value.(int64)
+		row.header = args[1].Value.([]byte)
+		row.body = args[2].Value.([]byte)
+		return driver.RowsAffected(1), nil
+
+	case strings.HasPrefix(query, "DELETE FROM idempotency_keys WHERE scope"):
+		delete(s.rows, args[0].Value.(string)+"\x00"+args[1].Value.(string))
+		return driver.RowsAffected(1), nil
+	}
+	return nil, errors.New("unexpected query: " + query)
+}
+
+type idempotencyRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *idempotencyRows) Columns() []string { return r.columns }
+
+func (r *idempotencyRows) Close() error { return nil }
+
+func (r *idempotencyRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// newIdempotencyTestApp() returns an application whose models use a fresh in-memory
+// idempotency store.
+func newIdempotencyTestApp(t *testing.T) *application {
+	t.Helper()
+
+	idempotencyStoresMu.Lock()
+	idempotencyStores[t.Name()] = &idempotencyStore{rows: map[string]*idempotencyRow{}}
+	idempotencyStoresMu.Unlock()
+
+	db, err := sql.Open("idempotencytest", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	app := &application{
+		logger: jsonlog.New(io.Discard, jsonlog.LevelOff),
+		db:     db,
+		models: data.NewModels(db),
+	}
+	app.config.idempotency.ttl = time.Hour
+	return app
+}
+
+// idempotencyRequest() sends a request through the middleware as the given user.
+func idempotencyRequest(app *application, h http.Handler, user *data.User, method, path, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.RemoteAddr = "192.0.2.1:1234"
+	if key != "" {
+		r.Header.Set("Idempotency-Key", key)
+	}
+	r = app.contextSetUser(r, user)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	return rr
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	app := newIdempotencyTestApp(t)
+
+	calls := 0
+	h := app.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/v1/movies/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"echo":` + string(body) + `}`))
+	}))
+	user := &data.User{ID: 1}
+
+	first := idempotencyRequest(app, h, user, http.MethodPost, "/v1/movies", "abc", `"moana"`)
+	if first.Code != http.StatusCreated || calls != 1 {
+		t.Fatalf("first request: status %d, %d calls; want 201, 1 call", first.Code, calls)
+	}
+	if first.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("first request was marked as replayed")
+	}
+
+	replay := idempotencyRequest(app, h, user, http.MethodPost, "/v1/movies", "abc", `"moana"`)
+	if calls != 1 {
+		t.Errorf("replay ran the handler again (%d calls)", calls)
+	}
+	if replay.Code != http.StatusCreated {
+		t.Errorf("replay status = %d; want %d", replay.Code, http.StatusCreated)
+	}
+	if replay.Body.String() != first.Body.String() {
+		t.Errorf("replay body = %q; want %q", replay.Body.String(), first.Body.String())
+	}
+	if replay.Header().Get("Location") != "/v1/movies/1" {
+		t.Errorf("replay Location = %q; want the stored header", replay.Header().Get("Location"))
+	}
+	if replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replay is missing the Idempotent-Replayed header")
+	}
+
+	// The same key for a different request is a conflict.
+	conflict := idempotencyRequest(app, h, user, http.MethodPost, "/v1/movies", "abc", `"frozen"`)
+	if conflict.Code != http.StatusConflict || calls != 1 {
+		t.Errorf("reused key: status %d, %d calls; want 409, 1 call", conflict.Code, calls)
+	}
+
+	// Keys are scoped to the user, so another user's key is independent.
+	other := idempotencyRequest(app, h, &data.User{ID: 2}, http.MethodPost, "/v1/movies", "abc", `"frozen"`)
+	if other.Code != http.StatusCreated || calls != 2 {
+		t.Errorf("other user: status %d, %d calls; want 201, 2 calls", other.Code, calls)
+	}
+
+	// So are anonymous requests, by client address.
+	anonymous := idempotencyRequest(app, h, data.AnonymousUser, http.MethodPost, "/v1/movies", "abc", `"frozen"`)
+	if anonymous.Code != http.StatusCreated || calls != 3 {
+		t.Errorf("anonymous: status %d, %d calls; want 201, 3 calls", anonymous.Code, calls)
+	}
+}
+
+func TestIdempotentReleasesServerErrors(t *testing.T) {
+	app := newIdempotencyTestApp(t)
+
+	calls := 0
+	h := app.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	user := &data.User{ID: 1}
+
+	idempotencyRequest(app, h, user, http.MethodPost, "/v1/movies", "abc", `{}`)
+	retry := idempotencyRequest(app, h, user, http.MethodPost, "/v1/movies", "abc", `{}`)
+	if retry.Code != http.StatusAccepted || calls != 2 {
+		t.Errorf("retry after a server error: status %d, %d calls; want 202, 2 calls", retry.Code, calls)
+	}
+}
+
+func TestIdempotentSkippedRequests(t *testing.T) {
+	app := newIdempotencyTestApp(t)
+
+	calls := 0
+	h := app.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusCreated)
+	}))
+	user := &data.User{ID: 1}
+
+	tests := []struct {
+		method string
+		path   string
+		key    string
+	}{
+		{method: http.MethodPost, path: "/v1/movies", key: ""},
+		{method: http.MethodPatch, path: "/v1/movies/1", key: "abc"},
+		{method: http.MethodPost, path: "/v1/tokens/authentication", key: "abc"},
+	}
+
+	for _, tt := range tests {
+		before := calls
+		for i := 0; i < 2; i++ {
+			rr := idempotencyRequest(app, h, user, tt.method, tt.path, tt.key, `{}`)
+			if rr.Header().Get("Idempotent-Replayed") != "" {
+				t.Errorf("%s %s (key %q) was replayed", tt.method, tt.path, tt.key)
+			}
+		}
+		if calls-before != 2 {
+			t.Errorf("%s %s (key %q) ran the handler %d times; want 2", tt.method, tt.path, tt.key, calls-before)
+		}
+	}
+
+	long := idempotencyRequest(app, h, user, http.MethodPost, "/v1/movies", strings.Repeat("k", idempotencyKeyMaxLength+1), `{}`)
+	if long.Code != http.StatusBadRequest {
+		t.Errorf("over-long key: status %d; want 400", long.Code)
+	}
+}
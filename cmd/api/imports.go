@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asd/asd/internal/data"
+	"github.com/asd/asd/internal/validator"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Imports are allowed a much bigger body than the 1MB readJSON() limit.
+	importMaxBytes = 32 << 20
+	// Movies are inserted in transactions of this many rows.
+	importBatchSize = 500
+	// Uploads with more rows than this are processed in the background.
+	importSyncLimit = 1000
+)
+
+// errImportBatchFailed is recorded on an import in which a batch failed to insert. The
+// database error itself is only logged.
+var errImportBatchFailed = errors.New("some rows could not be inserted because of a database error")
+
+// importRow is a single parsed line of an import file. Either movie is set, or errors
+// explains why the line couldn't be parsed or validated.
+type importRow struct {
+	line   int
+	movie  *data.Movie
+	errors map[string]string
+}
+
+// importParsers maps each import format to the function which parses it.
+var importParsers = map[string]func(io.Reader) ([]importRow, error){
+	"csv":    parseCSVImport,
+	"ndjson": parseNDJSONImport,
+}
+
+// parseCSVImport() reads movies from a CSV file with a header row naming the title, year,
+// runtime and genres columns. Multiple genres in one cell are separated by "|".
+func parseCSVImport(body io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("body must not be empty")
+		}
+		return nil, fmt.Errorf("body contains badly-formed CSV: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"title", "year", "runtime", "genres"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("CSV header must contain a %q column", name)
+		}
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			var parseError *csv.ParseError
+			if errors.As(err, &parseError) {
+				rows = append(rows, importRow{line: parseError.StartLine, errors: map[string]string{"csv": parseError.Err.Error()}})
+				continue
+			}
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		row := importRow{line: line, movie: &data.Movie{}, errors: map[string]string{}}
+		field := func(name string) string {
+			if i := columns[name]; i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		row.movie.Title = field("title")
+		if year, err := strconv.ParseInt(field("year"), 10, 32); err == nil {
+			row.movie.Year = int32(year)
+		} else {
+			row.errors["year"] = "must be an integer value"
+		}
+		if runtime, err := data.ParseRuntime(field("runtime")); err == nil {
+			row.movie.Runtime = runtime
+		} else {
+			row.errors["runtime"] = `must be a number of minutes, "102 mins" or "1h42m"`
+		}
+		if genres := field("genres"); genres != "" {
+			row.movie.Genres = strings.Split(genres, "|")
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseNDJSONImport() reads movies from newline-delimited JSON, one movie object per
+// line, using the same fields as POST /v1/movies. Blank lines are skipped.
+func parseNDJSONImport(body io.Reader) ([]importRow, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1_048_576)
+
+	var rows []importRow
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		var input struct {
+			Title   string       `json:"title"`
+			Year    int32        `json:"year"`
+			Runtime data.Runtime `json:"runtime"`
+			Genres  []string     `json:"genres"`
+		}
+		dec := json.NewDecoder(bytes.NewReader(text))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&input); err != nil {
+			rows = append(rows, importRow{line: line, errors: map[string]string{"json": err.Error()}})
+			continue
+		}
+
+		rows = append(rows, importRow{
+			line: line,
+			movie: &data.Movie{
+				Title:   input.Title,
+				Year:    input.Year,
+				Runtime: input.Runtime,
+				Genres:  input.Genres,
+			},
+			errors: map[string]string{},
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// runImport() validates the parsed rows and inserts the valid ones in batches. If a
+// batch fails to insert, every row in that batch is reported as failed, the rows in
+// other batches are unaffected, and errImportBatchFailed is returned along with the
+// results. Unless allowDuplicate is set, rows which look like a movie we already have
+// (or an earlier row) fail, as they would with POST /v1/movies.
+func (app *application) runImport(rows []importRow, genres data.GenreLookup, editorID int64, allowDuplicate bool) ([]data.ImportResult, error) {
+	results := make([]data.ImportResult, len(rows))
+
+	var batch []*data.Movie
+	var batchIndexes []int
+	var importErr error
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		// The movie.created events are published in the same transaction as the batch.
+		var duplicates map[int]*data.BatchDuplicate
+		err := app.models.InTransaction(context.Background(), func(models data.Models) error {
+			var err error
+			duplicates, err = models.Movies.InsertBatch(batch, editorID, allowDuplicate)
+			if err != nil {
+				return err
+			}
+			for n, movie := range batch {
+				if duplicates[n] == nil {
+					err = publishEvent(models, data.EventMovieCreated, envelope{"movie": movie})
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		for n, i := range batchIndexes {
+			switch {
+			case err != nil:
+				results[i].Status = "failed"
+				results[i].Errors = map[string]string{"database": "batch could not be inserted"}
+			case duplicates[n] != nil:
+				results[i].Status = "failed"
+				results[i].Errors = map[string]string{"title": duplicateImportMessage(rows, batchIndexes, duplicates[n])}
+			default:
+				results[i].Status = "created"
+				results[i].MovieID = batch[n].ID
+			}
+		}
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"import_batch_size": strconv.Itoa(len(batch))})
+			importErr = errImportBatchFailed
+		}
+		batch, batchIndexes = nil, nil
+	}
+
+	for i, row := range rows {
+		results[i].Line = row.line
+
+		if row.movie != nil {
+			v := validator.New()
+			// Parse errors take precedence over validation errors for the same field.
+			for key, message := range row.errors {
+				v.AddError(key, message)
+			}
+			if data.ValidateMovie(v, row.movie, genres); v.Valid() {
+				batch = append(batch, row.movie)
+				batchIndexes = append(batchIndexes, i)
+				if len(batch) == importBatchSize {
+					flush()
+				}
+				continue
+			}
+			row.errors = v.Errors
+		}
+
+		results[i].Status = "failed"
+		results[i].Errors = row.errors
+	}
+	flush()
+
+	return results, importErr
+}
+
+// duplicateImportMessage() explains why a row was skipped as a duplicate, pointing at
+// the existing movie or the earlier line of the file that it matches.
+func duplicateImportMessage(rows []importRow, batchIndexes []int, duplicate *data.BatchDuplicate) string {
+	if len(duplicate.MovieIDs) > 0 {
+		return fmt.Sprintf("looks like a duplicate of movie %d, use allow_duplicate=true to import it anyway", duplicate.MovieIDs[0])
+	}
+	return fmt.Sprintf("looks like a duplicate of line %d, use allow_duplicate=true to import it anyway", rows[batchIndexes[duplicate.Earlier[0]]].line)
+}
+
+// The importMoviesHandler() accepts a CSV (text/csv) or NDJSON (application/x-ndjson)
+// upload. Small imports are processed straight away and the per-row report is
+// returned in the response. Larger ones are stored and run from the job queue, and the
+// client gets a 202 Accepted with the location of the import job to poll.
+func (app *application) importMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var format string
+
+	switch requestMediaType(r) {
+	case "text/csv":
+		format = "csv"
+	case "application/x-ndjson", "application/ndjson":
+		format = "ndjson"
+	default:
+		app.unsupportedMediaTypeResponse(w, r)
+		return
+	}
+
+	// As with POST /v1/movies, ?allow_duplicate=true lets rows through which look like
+	// movies we already have.
+	v := validator.New()
+	allowDuplicate := app.readBool(r.URL.Query(), "allow_duplicate", false, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The upload is kept, as a large import is parsed again when it runs.
+	r.Body = http.MaxBytesReader(w, r.Body, importMaxBytes)
+	source, err := io.ReadAll(r.Body)
+	if err != nil {
+		if err.Error() == "http: request body too large" {
+			err = fmt.Errorf("body must not be larger than %d bytes", importMaxBytes)
+		}
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	rows, err := importParsers[format](bytes.NewReader(source))
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if len(rows) == 0 {
+		app.badRequestResponse(w, r, errors.New("body must contain at least one movie"))
+		return
+	}
+
+	// The genre taxonomy is loaded once for the whole import.
+	genres, err := app.models.Genres.Lookup()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	if len(rows) <= importSyncLimit {
+		results, err := app.runImport(rows, genres, user.ID, allowDuplicate)
+		job := summarizeImport(&data.ImportJob{Format: format, Total: len(rows)}, results, err)
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"import": job}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	job := &data.ImportJob{
+		UserID:         user.ID,
+		Format:         format,
+		Status:         data.ImportPending,
+		Total:          len(rows),
+		Source:         source,
+		AllowDuplicate: allowDuplicate,
+	}
+	err = app.models.InTransaction(r.Context(), func(models data.Models) error {
+		err := models.ImportJobs.Insert(job)
+		if err != nil {
+			return err
+		}
+		return models.Jobs.Enqueue(data.JobMovieImport, data.MovieImportJob{ImportID: job.ID})
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/imports/%d", job.ID))
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"import": job}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// summarizeImport() fills in the counters and final status of a job from its results.
+// A job which hit an error is failed, with the error recorded, even though the rows in
+// the results which were created stay created.
+func summarizeImport(job *data.ImportJob, results []data.ImportResult, err error) *data.ImportJob {
+	job.Results = results
+	if job.Results == nil {
+		job.Results = []data.ImportResult{}
+	}
+	job.Created, job.Failed = 0, 0
+	for _, result := range results {
+		if result.Status == "created" {
+			job.Created++
+		} else {
+			job.Failed++
+		}
+	}
+	now := time.Now()
+	job.Status = data.ImportCompleted
+	job.Error = ""
+	if err != nil {
+		job.Status = data.ImportFailed
+		job.Error = err.Error()
+	}
+	job.FinishedAt = &now
+	return job
+}
+
+// runImportJob() runs an asynchronous import from the job queue. Once the import has
+// started some of its rows may have been created, so from then on it's never run again:
+// any failure, even a panic, marks the import failed. An attempt which finds that an
+// earlier one started the import but never finished it marks it interrupted. The
+// earlier attempt is known to be gone, as the job is only claimed again once its
+// worker has stopped renewing the lease.
+func (app *application) runImportJob(queued *data.Job) (err error) {
+	var payload data.MovieImportJob
+	err = json.Unmarshal(queued.Payload, &payload)
+	if err != nil {
+		return err
+	}
+
+	job, err := app.models.ImportJobs.Start(payload.ImportID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			return app.models.ImportJobs.Interrupt(payload.ImportID)
+		default:
+			return err
+		}
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			app.logger.PrintError(fmt.Errorf("%s", p), map[string]string{"import_job": strconv.FormatInt(job.ID, 10)})
+			summarizeImport(job, nil, errors.New("import stopped unexpectedly"))
+			err = app.models.ImportJobs.Update(job)
+		}
+	}()
+
+	results, err := app.importSource(job)
+	summarizeImport(job, results, err)
+	return app.models.ImportJobs.Update(job)
+}
+
+// importSource() parses and imports the file stored with an import job.
+func (app *application) importSource(job *data.ImportJob) ([]data.ImportResult, error) {
+	parse, ok := importParsers[job.Format]
+	if !ok {
+		return nil, fmt.Errorf("unknown import format %q", job.Format)
+	}
+	rows, err := parse(bytes.NewReader(job.Source))
+	if err != nil {
+		return nil, err
+	}
+
+	genres, err := app.models.Genres.Lookup()
+	if err != nil {
+		return nil, err
+	}
+	return app.runImport(rows, genres, job.UserID, job.AllowDuplicate)
+}
+
+func (app *application) showImportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	// Only the user who started an import can see its report.
+	job, err := app.models.ImportJobs.Get(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"import": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
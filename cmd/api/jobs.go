@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asd/asd/internal/data"
+	"github.com/asd/asd/internal/validator"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A jobHandler runs one kind of job, with the JSON payload in job.Payload. Returning an
+// error (or panicking) fails the attempt, and the job is retried later.
+type jobHandler func(job *data.Job) error
+
+// jobHandlers() maps each job kind to the function which runs it.
+func (app *application) jobHandlers() map[string]jobHandler {
+	return map[string]jobHandler{
+		data.JobWelcomeEmail: app.sendWelcomeEmailJob,
+		data.JobMovieImport:  app.runImportJob,
+	}
+}
+
+// startJobWorkers() starts a pool of workers which run jobs from the queue. A worker
+// that finds the queue empty checks again after the poll interval.
+func (app *application) startJobWorkers(concurrency int, poll time.Duration) {
+	handlers := app.jobHandlers()
+
+	for i := 0; i < concurrency; i++ {
+		go func(worker int) {
+			for {
+				job, err := app.models.Jobs.Claim()
+				if err != nil {
+					app.logger.PrintError(err, map[string]string{"job_worker": strconv.Itoa(worker)})
+					time.Sleep(poll)
+					continue
+				}
+				if job == nil {
+					time.Sleep(poll)
+					continue
+				}
+				app.runJob(handlers, job)
+			}
+		}(i + 1)
+	}
+}
+
+// runJob() runs a claimed job and records the outcome. The job's lease is renewed while
+// it runs, so a long import isn't claimed again by another worker.
+func (app *application) runJob(handlers map[string]jobHandler, job *data.Job) {
+	properties := map[string]string{"job": strconv.FormatInt(job.ID, 10), "kind": job.Kind}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(data.JobHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := app.models.Jobs.Heartbeat(job)
+				if err != nil {
+					app.logger.PrintError(err, properties)
+				}
+			}
+		}
+	}()
+
+	err := func() (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %s", p)
+			}
+		}()
+
+		handler, ok := handlers[job.Kind]
+		if !ok {
+			return fmt.Errorf("unknown job kind %q", job.Kind)
+		}
+		return handler(job)
+	}()
+	close(done)
+
+	if err != nil {
+		app.logger.PrintError(err, properties)
+	}
+
+	err = app.models.Jobs.Finish(job, err)
+	if err != nil {
+		app.logger.PrintError(err, properties)
+		return
+	}
+	if job.Status == data.JobDead {
+		app.logger.PrintError(errors.New("job has run out of attempts"), properties)
+	}
+}
+
+// sendWelcomeEmailJob() sends a new user their welcome email. A new activation token is
+// made for each attempt, so no plaintext token is ever stored in the queue.
+func (app *application) sendWelcomeEmailJob(queued *data.Job) error {
+	var job data.WelcomeEmailJob
+	err := json.Unmarshal(queued.Payload, &job)
+	if err != nil {
+		return err
+	}
+
+	token, err := app.models.Tokens.New(job.UserID, 3*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	// As there are multiple pieces of data that we want to pass to our email
+	// templates, we create a map to act as a 'holding structure' for the data. This
+	// contains the plaintext version of the activation token for the user, along
+	// with their ID.
+	Data := map[string]interface{}{
+		"activationToken": token.Plaintext,
+		"userID":          job.UserID,
+	}
+	return app.mailer.Send(job.Email, "user_welcome.tmpl", Data)
+}
+
+// The listJobsHandler() returns a page of the jobs with the status given in ?status=
+// ("dead" by default), newest first.
+func (app *application) listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Status string
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Status = app.readString(qs, "status", data.JobDead)
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// Jobs are always returned newest first.
+	input.Filters.Sort = "-id"
+	input.Filters.SortSafelist = []string{"-id"}
+
+	v.Check(validator.In(input.Status, data.JobPending, data.JobRunning, data.JobSucceeded, data.JobDead), "status", "invalid status value")
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	jobs, metadata, err := app.models.Jobs.GetAll(input.Status, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"jobs": jobs, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The retryJobHandler() puts a dead job back in the queue.
+func (app *application) retryJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	job, err := app.models.Jobs.Retry(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"job": job}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
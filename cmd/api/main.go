@@ -8,11 +8,14 @@ import (
 	"github.com/asd/asd/internal/data"
 	"github.com/asd/asd/internal/jsonlog"
 	"github.com/asd/asd/internal/mailer"
+	"github.com/asd/asd/internal/storage"
 	"github.com/joho/godotenv"
 	"log"
 	"net/http"
 	"os"
-	"sync"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-migrate/migrate/v4"
@@ -37,6 +40,10 @@ type config struct {
 		rps     float64
 		burst   int
 	}
+	mailer struct {
+		backend string
+		dir     string
+	}
 	smtp struct {
 		host     string
 		port     int
@@ -44,14 +51,38 @@ type config struct {
 		password string
 		sender   string
 	}
+	trash struct {
+		retention time.Duration
+	}
+	storage struct {
+		dir string
+	}
+	similarity struct {
+		refresh time.Duration
+	}
+	idempotency struct {
+		ttl time.Duration
+	}
+	webhooks struct {
+		poll time.Duration
+	}
+	events struct {
+		retention time.Duration
+	}
+	jobs struct {
+		concurrency int
+		poll        time.Duration
+	}
 }
 
 type application struct {
 	config config
 	logger *jsonlog.Logger
+	db     *sql.DB
 	models data.Models
 	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	blobs  storage.BlobStore
+	events *eventBroker
 }
 
 func main() {
@@ -74,16 +105,47 @@ func main() {
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
-	// Read the SMTP server configuration settings into the config struct, using the
-	// Mailtrap settings as the default values. IMPORTANT: If you're following along,
-	// make sure to replace the default values for smtp-username and smtp-password
-	// with your own Mailtrap credentials.
+	// Emails are only sent over SMTP with -mailer=smtp, the default outside development.
+	// The other backends keep them on this machine: "file" drops .eml files into
+	// -mailer-dir, and in development only, "memory" keeps them for GET /debug/mail and
+	// "log" (the default there) just logs them.
+	flag.StringVar(&cfg.mailer.backend, "mailer", "", "Mailer backend (smtp|file|memory|log, default log in development and smtp otherwise)")
+	flag.StringVar(&cfg.mailer.dir, "mailer-dir", "./tmp/mail", "Directory for the file mailer backend")
+	// Read the SMTP server configuration settings into the config struct. The
+	// credentials default to the GREENLIGHT_SMTP_USERNAME and GREENLIGHT_SMTP_PASSWORD
+	// environment variables, rather than being hard-coded.
 	flag.StringVar(&cfg.smtp.host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
 	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", "46728e1c08ff93", "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", "acad7d2c32cbab", "SMTP password")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", os.Getenv("GREENLIGHT_SMTP_USERNAME"), "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", os.Getenv("GREENLIGHT_SMTP_PASSWORD"), "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.alexedwards.net>", "SMTP sender")
 
+	// How long a deleted movie stays in the trash before an admin purge is allowed to
+	// remove it permanently.
+	flag.DurationVar(&cfg.trash.retention, "trash-retention", 30*24*time.Hour, "Retention period for deleted movies")
+
+	// Uploaded images are kept on the local filesystem below this directory.
+	flag.StringVar(&cfg.storage.dir, "storage-dir", "./storage", "Directory for uploaded files")
+
+	// How often the similar movies table behind /similar and recommendations is rebuilt.
+	// A zero duration turns the refresher off.
+	flag.DurationVar(&cfg.similarity.refresh, "similarity-refresh", time.Hour, "Interval between similar movie refreshes (0 to disable)")
+
+	// How long the response to a POST with an Idempotency-Key is kept for replaying.
+	flag.DurationVar(&cfg.idempotency.ttl, "idempotency-ttl", 24*time.Hour, "How long Idempotency-Key responses are kept")
+
+	// How often the webhook outbox is checked for deliveries that are due. A zero
+	// duration turns delivery off.
+	flag.DurationVar(&cfg.webhooks.poll, "webhook-poll", 5*time.Second, "Interval between webhook outbox polls (0 to disable)")
+
+	// How long changes are kept in the event log for streams to resume from.
+	flag.DurationVar(&cfg.events.retention, "events-retention", 7*24*time.Hour, "Retention period for the change event log")
+
+	// Background jobs (such as welcome emails) are run by this many workers, which
+	// check the queue at this interval when it's empty.
+	flag.IntVar(&cfg.jobs.concurrency, "jobs-concurrency", 4, "Number of background job workers")
+	flag.DurationVar(&cfg.jobs.poll, "jobs-poll", time.Second, "Interval between job queue polls when idle")
+
 	flag.Parse() // give our config file values
 
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
@@ -111,26 +173,55 @@ func main() {
 	}
 	logger.PrintInfo("database migrations applied", nil)
 
-	version, _, err := migrator.Version()
+	// After migrating, the database must be at exactly the newest migration shipped in
+	// ./migrations. Anything else means a migration failed part way (dirty), or the
+	// database has been migrated by a newer release than this one.
+	version, dirty, err := migrator.Version()
 	if err != nil && err != migrate.ErrNoChange {
 		logger.PrintFatal(err, nil)
-	} else if version > 10 {
-		logger.PrintFatal(nil, map[string]string{
-			"message": "Version is bigger than 10!",
-		})
 	}
-
-	// TODO: print fatal for version checker
+	latest, err := latestMigration("migrations")
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	if dirty || version != latest {
+		logger.PrintFatal(fmt.Errorf("database is at migration %d (dirty: %t), expected %d", version, dirty, latest), nil)
+	}
 
 	logger.PrintInfo(fmt.Sprintf("Your current version is %v", version), nil)
 	//******************************************************************************
 
+	blobs, err := storage.NewLocal(cfg.storage.dir)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	transport, err := newMailTransport(cfg, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
 	app := &application{
 		config: cfg,
 		logger: logger,
+		db:     db,
 		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		mailer: mailer.New(transport, cfg.smtp.sender),
+		blobs:  blobs,
+		events: newEventBroker(),
+	}
+
+	err = app.listenForEvents(cfg.db.dsn)
+	if err != nil {
+		logger.PrintFatal(err, nil)
 	}
+
+	app.startSimilarityRefresher(cfg.similarity.refresh)
+	app.startIdempotencySweeper()
+	app.startWebhookDispatcher(cfg.webhooks.poll)
+	app.startEventSweeper(cfg.events.retention)
+	app.startJobWorkers(cfg.jobs.concurrency, cfg.jobs.poll)
+
 	// Use the httprouter instance returned by app.routes() as the server handler.
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", cfg.port),
@@ -178,3 +269,58 @@ func openDB(cfg config) (*sql.DB, error) {
 	// Return the sql.DB connection pool.
 	return db, nil
 }
+
+// newMailTransport() returns the mailer backend selected by the -mailer flag. Without
+// the flag, development logs emails and every other environment sends them over SMTP.
+// The memory and log backends lose every email, so they're only allowed in development.
+func newMailTransport(cfg config, logger *jsonlog.Logger) (mailer.Sender, error) {
+	development := cfg.env == "development"
+
+	backend := cfg.mailer.backend
+	if backend == "" {
+		backend = "smtp"
+		if development {
+			backend = "log"
+		}
+	}
+	if (backend == "memory" || backend == "log") && !development {
+		return nil, fmt.Errorf("the %s mailer backend can only be used in development", backend)
+	}
+
+	switch backend {
+	case "smtp":
+		return mailer.NewSMTP(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password), nil
+	case "file":
+		return mailer.NewFile(cfg.mailer.dir)
+	case "memory":
+		return mailer.NewMemory(100), nil
+	case "log":
+		return mailer.NewLog(logger, development), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer backend %q", backend)
+	}
+}
+
+// latestMigration() returns the version of the newest migration in dir, taken from the
+// NNNNNN_name.up.sql file names.
+func latestMigration(dir string) (uint, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.up.sql"))
+	if err != nil {
+		return 0, err
+	}
+	var latest uint
+	for _, file := range files {
+		prefix := strings.SplitN(filepath.Base(file), "_", 2)[0]
+		version, err := strconv.ParseUint(prefix, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("migration %s has no version number", file)
+		}
+		if uint(version) > latest {
+			latest = uint(version)
+		}
+	}
+	if latest == 0 {
+		return 0, fmt.Errorf("no migrations found in %s", dir)
+	}
+	return latest, nil
+}
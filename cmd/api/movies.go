@@ -6,7 +6,9 @@ import (
 	"github.com/asd/asd/internal/data"
 	"github.com/asd/asd/internal/validator"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 )
 
 // Add a createMovieHandler for the "POST /v1/movies" endpoint.
@@ -17,15 +19,16 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	// of the Movie struct that we created earlier). This struct will be our *target
 	// decode destination*.
 	var input struct {
-		Title   string   `json:"title"`
-		Year    int32    `json:"year"`
-		Runtime int32    `json:"runtime"`
-		Genres  []string `json:"genres"`
+		Title   string       `json:"title"`
+		Year    int32        `json:"year"`
+		Runtime data.Runtime `json:"runtime"`
+		Genres  []string     `json:"genres"`
 	}
 	// if there is error with decoding, we are sending corresponding message
 	err := app.readJSON(w, r, &input) //non-nil pointer as the target decode destination
 	if err != nil {
 		app.badRequestResponse(w, r, err)
+		return
 	}
 
 	// Note that the movie variable contains a *pointer* to a Movie struct.
@@ -36,18 +39,58 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		Genres:  input.Genres,
 	}
 
+	genres, err := app.models.Genres.Lookup()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	v := validator.New()
-	if data.ValidateMovie(v, movie); !v.Valid() {
+	// A movie that looks like one we already have is rejected, unless the client
+	// confirms it really is a different film with ?allow_duplicate=true.
+	allowDuplicate := app.readBool(r.URL.Query(), "allow_duplicate", false, v)
+	if data.ValidateMovie(v, movie, genres); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
 	// Call the Insert() method on our movies model, passing in a pointer to the
 	// validated movie struct. This will create a record in the database and update the
-	// movie struct with the system-generated information.
-	err = app.models.Movies.Insert(movie)
+	// movie struct with the system-generated information. The first version of the
+	// movie is recorded in its revision history in the same transaction. The duplicate
+	// check runs in it too, under a lock on the title and year, so two identical
+	// requests at the same time can't both get past it.
+	var duplicates []*data.Movie
+	err = app.models.InTransaction(r.Context(), func(models data.Models) error {
+		err := models.Movies.LockDuplicates(movie)
+		if err != nil {
+			return err
+		}
+		duplicates, err = models.Movies.FindDuplicates(movie)
+		if err != nil {
+			return err
+		}
+		if len(duplicates) > 0 && !allowDuplicate {
+			return errDuplicateMovie
+		}
+
+		err = models.Movies.Insert(movie)
+		if err != nil {
+			return err
+		}
+		err = models.Revisions.Insert(movie, app.contextGetUser(r).ID)
+		if err != nil {
+			return err
+		}
+		return publishEvent(models, data.EventMovieCreated, envelope{"movie": movie})
+	})
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		switch {
+		case errors.Is(err, errDuplicateMovie):
+			app.duplicateMovieResponse(w, r, duplicates)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 	// When sending a HTTP response, we want to include a Location header to let the
@@ -57,8 +100,14 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
 	// Write a JSON response with a 201 Created status code, the movie data in the
-	// response body, and the Location header.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
+	// response body, and the Location header. A duplicate that was let through is
+	// still reported, as a warning.
+	env := envelope{"movie": movie}
+	if len(duplicates) > 0 {
+		setDuplicateLinks(headers, duplicates)
+		env["duplicates"] = duplicateRefs(duplicates)
+	}
+	err = app.writeJSON(w, http.StatusCreated, env, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -69,7 +118,17 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 	id, err := app.readIDParam(r) // get the id
 	if err != nil {
 		app.notFoundResponse(w, r)
+		return
 	}
+
+	// ?fields= and ?include= work the same as on GET /v1/movies.
+	v := validator.New()
+	fields := app.readFields(r.URL.Query(), movieFieldSafelist, movieIncludeSafelist)
+	if data.ValidateFields(v, fields); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
 	// Call the Get() method to fetch the data for a specific movie. We also need to
 	// use the errors.Is() function to check if it returns a data.ErrRecordNotFound
 	// error, in which case we send a 404 Not Found response to the client.
@@ -83,13 +142,34 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
-	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+
+	headers, err := app.localizeMovies(r, []*data.Movie{movie})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	shaped, err := app.shapeMovies([]*data.Movie{movie}, fields)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": shaped[0]}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
 func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Request) {
+	// Reject request bodies we don't know how to apply before doing anything else.
+	switch requestMediaType(r) {
+	case "", "application/json", contentTypeMergePatch, contentTypeJSONPatch:
+	default:
+		app.unsupportedMediaTypeResponse(w, r)
+		return
+	}
+
 	// Extract the movie ID from the URL.
 	id, err := app.readIDParam(r)
 	if err != nil {
@@ -116,50 +196,46 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	// Declare an input struct to hold the expected data from the client.
-	var input struct {
-		Title *string `json:"title"`
-		Year  *int32  `json:"year"`
-		//Runtime data.Runtime `json:"runtime"`
-		Runtime *int32   `json:"runtime"`
-		Genres  []string `json:"genres"`
-	}
-	// Read the JSON request body data into the input struct.
-	err = app.readJSON(w, r, &input)
+	// Apply the request body to the movie. Depending on the Content-Type this is a
+	// plain JSON partial update, an RFC 7396 merge patch or an RFC 6902 JSON Patch.
+	err = app.readMoviePatch(w, r, movie)
 	if err != nil {
-		app.badRequestResponse(w, r, err)
+		switch {
+		case errors.Is(err, errPatchTestFailed):
+			app.patchTestFailedResponse(w, r, err)
+		default:
+			app.badRequestResponse(w, r, err)
+		}
 		return
 	}
 
-	// If the input.Title value is nil then we know that no corresponding "title" key/
-	// value pair was provided in the JSON request body. So we move on and leave the
-	// movie record unchanged. Otherwise, we update the movie record with the new title
-	// value. Importantly, because input.Title is a now a pointer to a string, we need
-	// to dereference the pointer using the * operator to get the underlying value
-	// before assigning it to our movie record.
-	if input.Title != nil {
-		movie.Title = *input.Title
-	}
-	if input.Year != nil {
-		movie.Year = *input.Year
-	}
-	if input.Runtime != nil {
-		movie.Runtime = *input.Runtime
-	}
-	if input.Genres != nil {
-		movie.Genres = input.Genres // Note that we don't need to dereference a slice.
-	}
-
 	// Validate the updated movie record, sending the client a 422 Unprocessable Entity
 	// response if any checks fail.
+	genres, err := app.models.Genres.Lookup()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	v := validator.New()
-	if data.ValidateMovie(v, movie); !v.Valid() {
+	if data.ValidateMovie(v, movie, genres); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	// Pass the updated movie record to our new Update() method.
-	err = app.models.Movies.Update(movie)
+	// Pass the updated movie record to our new Update() method, and keep a snapshot of
+	// the new version in the revision history in the same transaction.
+	err = app.models.InTransaction(r.Context(), func(models data.Models) error {
+		err := models.Movies.Update(movie)
+		if err != nil {
+			return err
+		}
+		err = models.Revisions.Insert(movie, app.contextGetUser(r).ID)
+		if err != nil {
+			return err
+		}
+		return publishEvent(models, data.EventMovieUpdated, envelope{"movie": movie})
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -185,7 +261,13 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 	// Delete the movie from the database, sending a 404 Not Found response to the
 	// client if there isn't a matching record.
-	err = app.models.Movies.Delete(id)
+	err = app.models.InTransaction(r.Context(), func(models data.Models) error {
+		err := models.Movies.Delete(id)
+		if err != nil {
+			return err
+		}
+		return publishEvent(models, data.EventMovieDeleted, envelope{"movie": envelope{"id": id}})
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -203,33 +285,114 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+// readMovieQuery() reads the movie filtering parameters shared by the list and export
+// endpoints from the query string.
+func (app *application) readMovieQuery(qs url.Values, v *validator.Validator) data.MovieQuery {
+	var q data.MovieQuery
+
+	q.Title = app.readString(qs, "title", "")
+	q.Genres = app.readCSV(qs, "genres", []string{})
+	q.GenresMode = app.readString(qs, "genres_mode", "all")
+	q.ExcludeGenres = app.readCSV(qs, "exclude_genres", []string{})
+
+	q.YearMin = app.readInt(qs, "year_min", 0, v)
+	q.YearMax = app.readInt(qs, "year_max", 0, v)
+	q.RuntimeMin = app.readInt(qs, "runtime_min", 0, v)
+	q.RuntimeMax = app.readInt(qs, "runtime_max", 0, v)
+
+	q.CreatedAfter = app.readTime(qs, "created_after", time.Time{}, v)
+	q.CreatedBefore = app.readTime(qs, "created_before", time.Time{}, v)
+
+	return q
+}
+
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title  string
-		Genres []string
+		data.MovieQuery
+		Facets []string
 		data.Filters
+		data.Fields
 	}
 	// Initialize a new Validator instance.
 	v := validator.New()
 	// Call r.URL.Query() to get the url.Values map containing the query string data.
 	qs := r.URL.Query()
 
-	input.Title = app.readString(qs, "title", "")
-	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.MovieQuery = app.readMovieQuery(qs, v)
+	input.Facets = app.readCSV(qs, "facets", []string{})
+	for _, facet := range input.Facets {
+		v.Check(validator.In(facet, data.FacetSafelist...), "facets", "must be a comma-separated list of genres, year or decade")
+	}
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 	// Extract the sort query string value, falling back to "id" if it is not provided
 	// by the client (which will imply a ascending sort on movie ID).
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "average_rating", "rating_count", "relevance", "-id", "-title", "-year", "-runtime", "-average_rating", "-rating_count", "-relevance"}
+	// Several keys can be given, for example ?sort=-year,title.
+	var byRelevance bool
+	input.Filters.Sort, byRelevance = descendingRelevance(input.Filters.Sort)
+	v.Check(!byRelevance || input.Title != "", "sort", "relevance can only be used with a title search")
+
+	input.Fields = app.readFields(qs, movieFieldSafelist, movieIncludeSafelist)
 
+	data.ValidateMovieQuery(v, input.MovieQuery)
+	data.ValidateFields(v, input.Fields)
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, facets, err := app.models.Movies.GetAllWithFacets(input.MovieQuery, input.Filters, input.Facets)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers, err := app.localizeMovies(r, movies)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	shaped, err := app.shapeMovies(movies, input.Fields)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"movies": shaped, "metadata": metadata}
+	// Only include the facets key when the client asked for it.
+	if len(input.Facets) > 0 {
+		env["facets"] = facets
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listTrashedMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// The trash is always ordered by deletion time, so there is only one sort value.
+	input.Filters.Sort = "-deleted_at"
+	input.Filters.SortSafelist = []string{"-deleted_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	movies, metadata, err := app.models.Movies.GetAllDeleted(input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -240,3 +403,49 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) restoreMovieHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	// Take the movie out of the trash, sending a 404 Not Found response if there is no
+	// trashed movie with this ID. Webhooks get the same movie.restored event as the
+	// event stream.
+	var movie *data.Movie
+	err = app.models.InTransaction(r.Context(), func(models data.Models) error {
+		movie, err = models.Movies.Restore(id)
+		if err != nil {
+			return err
+		}
+		return publishEvent(models, data.EventMovieRestored, envelope{"movie": movie})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The purgeMoviesHandler() permanently deletes every movie which has been in the trash
+// for longer than the configured retention period.
+func (app *application) purgeMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	purged, err := app.models.Movies.Purge(app.config.trash.retention)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"purged": purged, "retention": app.config.trash.retention.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asd/asd/internal/data"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Media types accepted by updateMovieHandler in addition to plain application/json.
+const (
+	contentTypeMergePatch = "application/merge-patch+json" // RFC 7396
+	contentTypeJSONPatch  = "application/json-patch+json"  // RFC 6902
+)
+
+// errPatchTestFailed is returned when a JSON Patch "test" operation doesn't match the
+// current state of the record. The whole patch is rejected in that case.
+var errPatchTestFailed = errors.New("patch test operation failed")
+
+// A single RFC 6902 operation. Only add, remove, replace and test are supported.
+type jsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// movieField returns a pointer to the movie field addressed by a patch member name,
+// or nil if the field can't be patched.
+func movieField(movie *data.Movie, name string) interface{} {
+	switch name {
+	case "title":
+		return &movie.Title
+	case "year":
+		return &movie.Year
+	case "runtime":
+		return &movie.Runtime
+	case "genres":
+		return &movie.Genres
+	default:
+		return nil
+	}
+}
+
+// applyMergePatch() applies an RFC 7396 merge patch to the movie. Members set to null
+// reset the field to its zero value (so ValidateMovie will report them as missing),
+// any other value replaces the field entirely.
+func applyMergePatch(movie *data.Movie, patch map[string]json.RawMessage) error {
+	for name, raw := range patch {
+		field := movieField(movie, name)
+		if field == nil {
+			return fmt.Errorf("body contains unknown key %q", name)
+		}
+		// Setting the field to its zero value before unmarshalling means that a JSON
+		// null (which json.Unmarshal ignores) removes the field.
+		reflect.ValueOf(field).Elem().Set(reflect.Zero(reflect.TypeOf(field).Elem()))
+		if err := json.Unmarshal(raw, field); err != nil {
+			if errors.Is(err, data.ErrInvalidRuntimeFormat) {
+				return fmt.Errorf("body contains %v", err)
+			}
+			return fmt.Errorf("body contains incorrect JSON type for field %q", name)
+		}
+	}
+	return nil
+}
+
+// applyJSONPatch() applies a list of RFC 6902 operations to the movie in order. The
+// supported paths are /title, /year, /runtime, /genres and /genres/<index> (with "-"
+// meaning the end of the array for "add").
+func applyJSONPatch(movie *data.Movie, operations []jsonPatchOperation) error {
+	for i, op := range operations {
+		if !strings.HasPrefix(op.Path, "/") {
+			return fmt.Errorf("operation %d: invalid path %q", i, op.Path)
+		}
+		segments := strings.Split(strings.TrimPrefix(op.Path, "/"), "/")
+
+		var err error
+		switch {
+		case len(segments) == 1:
+			err = patchMovieField(movie, op, segments[0])
+		case len(segments) == 2 && segments[0] == "genres":
+			err = patchGenre(movie, op, segments[1])
+		default:
+			err = fmt.Errorf("path %q is not supported", op.Path)
+		}
+		if err != nil {
+			if errors.Is(err, errPatchTestFailed) {
+				return fmt.Errorf("operation %d: %w", i, err)
+			}
+			return fmt.Errorf("operation %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+func patchMovieField(movie *data.Movie, op jsonPatchOperation, name string) error {
+	field := movieField(movie, name)
+	if field == nil {
+		return fmt.Errorf("path %q is not supported", op.Path)
+	}
+	fieldValue := reflect.ValueOf(field).Elem()
+
+	switch op.Op {
+	case "add", "replace":
+		if op.Value == nil {
+			return errors.New("value must be provided")
+		}
+		fieldValue.Set(reflect.Zero(fieldValue.Type()))
+		if err := json.Unmarshal(op.Value, field); err != nil {
+			if errors.Is(err, data.ErrInvalidRuntimeFormat) {
+				return err
+			}
+			return fmt.Errorf("incorrect JSON type for %q", op.Path)
+		}
+	case "remove":
+		fieldValue.Set(reflect.Zero(fieldValue.Type()))
+	case "test":
+		expected := reflect.New(fieldValue.Type())
+		if err := json.Unmarshal(op.Value, expected.Interface()); err != nil {
+			if errors.Is(err, data.ErrInvalidRuntimeFormat) {
+				return err
+			}
+			return fmt.Errorf("incorrect JSON type for %q", op.Path)
+		}
+		if !reflect.DeepEqual(expected.Elem().Interface(), fieldValue.Interface()) {
+			return errPatchTestFailed
+		}
+	default:
+		return fmt.Errorf("unsupported op %q", op.Op)
+	}
+	return nil
+}
+
+func patchGenre(movie *data.Movie, op jsonPatchOperation, index string) error {
+	// "-" refers to the position after the last element, which is only meaningful
+	// for an add.
+	i := len(movie.Genres)
+	if index != "-" {
+		n, err := strconv.Atoi(index)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid array index %q", index)
+		}
+		i = n
+	} else if op.Op != "add" {
+		return fmt.Errorf("index \"-\" can only be used with add")
+	}
+
+	var genre string
+	if op.Op != "remove" {
+		if err := json.Unmarshal(op.Value, &genre); err != nil {
+			return fmt.Errorf("incorrect JSON type for %q", op.Path)
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		if i > len(movie.Genres) {
+			return fmt.Errorf("array index %d out of range", i)
+		}
+		movie.Genres = append(movie.Genres[:i], append([]string{genre}, movie.Genres[i:]...)...)
+	case "replace":
+		if i >= len(movie.Genres) {
+			return fmt.Errorf("array index %d out of range", i)
+		}
+		movie.Genres[i] = genre
+	case "remove":
+		if i >= len(movie.Genres) {
+			return fmt.Errorf("array index %d out of range", i)
+		}
+		movie.Genres = append(movie.Genres[:i], movie.Genres[i+1:]...)
+	case "test":
+		if i >= len(movie.Genres) || movie.Genres[i] != genre {
+			return errPatchTestFailed
+		}
+	default:
+		return fmt.Errorf("unsupported op %q", op.Op)
+	}
+	return nil
+}
+
+// requestMediaType() returns the media type of the request body without any parameters
+// such as charset.
+func requestMediaType(r *http.Request) string {
+	return strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+}
+
+// readMoviePatch() reads the request body according to its Content-Type and applies it
+// to the movie. Plain JSON keeps the original partial-update semantics where only the
+// fields present in the body are changed.
+func (app *application) readMoviePatch(w http.ResponseWriter, r *http.Request, movie *data.Movie) error {
+	switch requestMediaType(r) {
+	case contentTypeMergePatch:
+		var patch map[string]json.RawMessage
+		err := app.readJSON(w, r, &patch)
+		if err != nil {
+			return err
+		}
+		return applyMergePatch(movie, patch)
+
+	case contentTypeJSONPatch:
+		var operations []jsonPatchOperation
+		err := app.readJSON(w, r, &operations)
+		if err != nil {
+			return err
+		}
+		return applyJSONPatch(movie, operations)
+
+	default:
+		// Declare an input struct to hold the expected data from the client.
+		var input struct {
+			Title   *string       `json:"title"`
+			Year    *int32        `json:"year"`
+			Runtime *data.Runtime `json:"runtime"`
+			Genres  []string      `json:"genres"`
+		}
+		// Read the JSON request body data into the input struct.
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			return err
+		}
+
+		// If the input.Title value is nil then we know that no corresponding "title" key/
+		// value pair was provided in the JSON request body. So we move on and leave the
+		// movie record unchanged. Otherwise, we update the movie record with the new title
+		// value. Importantly, because input.Title is a now a pointer to a string, we need
+		// to dereference the pointer using the * operator to get the underlying value
+		// before assigning it to our movie record.
+		if input.Title != nil {
+			movie.Title = *input.Title
+		}
+		if input.Year != nil {
+			movie.Year = *input.Year
+		}
+		if input.Runtime != nil {
+			movie.Runtime = *input.Runtime
+		}
+		if input.Genres != nil {
+			movie.Genres = input.Genres // Note that we don't need to dereference a slice.
+		}
+		return nil
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/asd/asd/internal/data"
+	"reflect"
+	"testing"
+)
+
+func testMovie() *data.Movie {
+	return &data.Movie{
+		ID:      1,
+		Title:   "Moana",
+		Year:    2016,
+		Runtime: 107,
+		Genres:  []string{"animation", "adventure"},
+		Version: 1,
+	}
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   string
+		want    func(m *data.Movie)
+		wantErr bool
+	}{
+		{
+			name:  "replaces the given fields",
+			patch: `{"title": "Moana 2", "runtime": "1h40m"}`,
+			want: func(m *data.Movie) {
+				m.Title = "Moana 2"
+				m.Runtime = 100
+			},
+		},
+		{
+			name:  "replaces arrays entirely",
+			patch: `{"genres": ["comedy"]}`,
+			want: func(m *data.Movie) {
+				m.Genres = []string{"comedy"}
+			},
+		},
+		{
+			name:  "null resets a field",
+			patch: `{"year": null, "genres": null}`,
+			want: func(m *data.Movie) {
+				m.Year = 0
+				m.Genres = nil
+			},
+		},
+		{
+			name:  "empty patch changes nothing",
+			patch: `{}`,
+			want:  func(m *data.Movie) {},
+		},
+		{name: "unknown key", patch: `{"version": 9}`, wantErr: true},
+		{name: "wrong type", patch: `{"year": "2016"}`, wantErr: true},
+		{name: "invalid runtime", patch: `{"runtime": "107 minutes"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var patch map[string]json.RawMessage
+			err := json.Unmarshal([]byte(tt.patch), &patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			movie := testMovie()
+			err = applyMergePatch(movie, patch)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			want := testMovie()
+			tt.want(want)
+			if !reflect.DeepEqual(movie, want) {
+				t.Errorf("got %+v; want %+v", movie, want)
+			}
+		})
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct {
+		name           string
+		patch          string
+		want           func(m *data.Movie)
+		wantErr        bool
+		wantTestFailed bool
+	}{
+		{
+			name:  "replace a field",
+			patch: `[{"op": "replace", "path": "/title", "value": "Moana 2"}]`,
+			want: func(m *data.Movie) {
+				m.Title = "Moana 2"
+			},
+		},
+		{
+			name:  "add a genre at the end",
+			patch: `[{"op": "add", "path": "/genres/-", "value": "comedy"}]`,
+			want: func(m *data.Movie) {
+				m.Genres = []string{"animation", "adventure", "comedy"}
+			},
+		},
+		{
+			name:  "add a genre at an index",
+			patch: `[{"op": "add", "path": "/genres/0", "value": "comedy"}]`,
+			want: func(m *data.Movie) {
+				m.Genres = []string{"comedy", "animation", "adventure"}
+			},
+		},
+		{
+			name:  "replace and remove genres",
+			patch: `[{"op": "replace", "path": "/genres/1", "value": "family"}, {"op": "remove", "path": "/genres/0"}]`,
+			want: func(m *data.Movie) {
+				m.Genres = []string{"family"}
+			},
+		},
+		{
+			name:  "remove a field",
+			patch: `[{"op": "remove", "path": "/runtime"}]`,
+			want: func(m *data.Movie) {
+				m.Runtime = 0
+			},
+		},
+		{
+			name:  "passing tests guard the change",
+			patch: `[{"op": "test", "path": "/year", "value": 2016}, {"op": "test", "path": "/genres/1", "value": "adventure"}, {"op": "replace", "path": "/year", "value": 2017}]`,
+			want: func(m *data.Movie) {
+				m.Year = 2017
+			},
+		},
+		{
+			name:           "failed field test",
+			patch:          `[{"op": "test", "path": "/title", "value": "Frozen"}, {"op": "replace", "path": "/title", "value": "Moana 2"}]`,
+			wantErr:        true,
+			wantTestFailed: true,
+		},
+		{
+			name:           "failed genre test",
+			patch:          `[{"op": "test", "path": "/genres/5", "value": "comedy"}]`,
+			wantErr:        true,
+			wantTestFailed: true,
+		},
+		{name: "unsupported path", patch: `[{"op": "replace", "path": "/version", "value": 2}]`, wantErr: true},
+		{name: "relative path", patch: `[{"op": "replace", "path": "title", "value": "x"}]`, wantErr: true},
+		{name: "unsupported op", patch: `[{"op": "move", "from": "/title", "path": "/title"}]`, wantErr: true},
+		{name: "missing value", patch: `[{"op": "replace", "path": "/title"}]`, wantErr: true},
+		{name: "index out of range", patch: `[{"op": "remove", "path": "/genres/2"}]`, wantErr: true},
+		{name: "dash outside add", patch: `[{"op": "replace", "path": "/genres/-", "value": "comedy"}]`, wantErr: true},
+		{name: "wrong type", patch: `[{"op": "replace", "path": "/year", "value": "2017"}]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var operations []jsonPatchOperation
+			err := json.Unmarshal([]byte(tt.patch), &operations)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			movie := testMovie()
+			err = applyJSONPatch(movie, operations)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if got := errors.Is(err, errPatchTestFailed); got != tt.wantTestFailed {
+					t.Errorf("errors.Is(err, errPatchTestFailed) = %t; want %t (err: %v)", got, tt.wantTestFailed, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			want := testMovie()
+			tt.want(want)
+			if !reflect.DeepEqual(movie, want) {
+				t.Errorf("got %+v; want %+v", movie, want)
+			}
+		})
+	}
+}
@@ -1,12 +1,23 @@
 package main
 
 import (
+	"github.com/asd/asd/internal/data"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 func (app *application) routes() http.Handler {
+	router := app.router()
+
+	// Wrap the router with the panic recovery middleware.
+	//return app.recoverPanic(app.authenticate(router))
+	return app.recoverPanic(app.rateLimit(app.authenticate(app.idempotent(router))))
+}
+
+// router() registers every endpoint on a new router, without the middleware which
+// routes() wraps around it. Batch requests dispatch their operations to it directly.
+func (app *application) router() *httprouter.Router {
 	// Initialize a new httprouter router instance.
 	router := httprouter.New()
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
@@ -20,27 +31,115 @@ func (app *application) routes() http.Handler {
 	//movies
 	router.HandlerFunc(http.MethodGet, "/v1/movies", app.listMoviesHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/movies", app.createMovieHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.showMovieHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.paramSwitch(app.showMovieHandler, map[string]http.HandlerFunc{
+		"trash":   app.requirePermission(data.PermissionAdmin, app.listTrashedMoviesHandler),
+		"export":  app.requirePermission(data.PermissionAdmin, app.exportMoviesHandler),
+		"suggest": app.suggestHandler(app.models.Movies.Suggest),
+	}))
 	router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.updateMovieHandler)
 	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.deleteMovieHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id", app.paramSwitch(app.methodNotAllowedResponse, map[string]http.HandlerFunc{
+		"import": app.requireActivatedUser(app.importMoviesHandler),
+	}))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/restore", app.requirePermission(data.PermissionAdmin, app.restoreMovieHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/poster", app.requireActivatedUser(app.uploadArtworkHandler("poster")))
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/backdrop", app.requireActivatedUser(app.uploadArtworkHandler("backdrop")))
+
+	// similar movies and recommendations
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/similar", app.similarMoviesHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/recommendations", app.requireActivatedUser(app.recommendationsHandler))
+
+	// uploaded files
+	router.HandlerFunc(http.MethodGet, "/v1/static/*filepath", app.serveBlobHandler)
+
+	// movie translations
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/translations", app.listTranslationsHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/movies/:id/translations/:locale", app.requireActivatedUser(app.putTranslationHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/movies/:id/translations/:locale", app.requireActivatedUser(app.deleteTranslationHandler))
+
+	// imports
+	router.HandlerFunc(http.MethodGet, "/v1/imports/:id", app.requireActivatedUser(app.showImportHandler))
+
+	// movie revisions
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/revisions", app.listMovieRevisionsHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/revisions/:version", app.showMovieRevisionHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/revisions/:version/revert", app.requirePermission(data.PermissionAdmin, app.revertMovieHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/diff", app.diffMovieRevisionsHandler)
+
+	// admin
+	router.HandlerFunc(http.MethodPost, "/v1/admin/movies/:id", app.paramSwitch(app.methodNotAllowedResponse, map[string]http.HandlerFunc{
+		"purge": app.requirePermission(data.PermissionAdmin, app.purgeMoviesHandler),
+	}))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/movies/duplicates", app.requirePermission(data.PermissionAdmin, app.listDuplicateMoviesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/movies/:id/merge", app.requirePermission(data.PermissionAdmin, app.mergeMoviesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/genres", app.requirePermission(data.PermissionAdmin, app.createGenreHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/genres/:id", app.requirePermission(data.PermissionAdmin, app.updateGenreHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/genres/:id/merge", app.requirePermission(data.PermissionAdmin, app.mergeGenresHandler))
+
+	// background jobs
+	router.HandlerFunc(http.MethodGet, "/v1/admin/jobs", app.requirePermission(data.PermissionAdmin, app.listJobsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/jobs/:id/retry", app.requirePermission(data.PermissionAdmin, app.retryJobHandler))
+
+	// webhooks
+	router.HandlerFunc(http.MethodGet, "/v1/admin/webhooks", app.requirePermission(data.PermissionAdmin, app.listWebhooksHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/webhooks", app.requirePermission(data.PermissionAdmin, app.createWebhookHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/webhooks/:id", app.requirePermission(data.PermissionAdmin, app.updateWebhookHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/webhooks/:id", app.requirePermission(data.PermissionAdmin, app.deleteWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/webhooks/:id/deliveries", app.requirePermission(data.PermissionAdmin, app.listWebhookDeliveriesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/webhooks/:id/deliveries/:delivery_id/redeliver", app.requirePermission(data.PermissionAdmin, app.redeliverWebhookHandler))
+
+	// genres
+	router.HandlerFunc(http.MethodGet, "/v1/genres", app.listGenresHandler)
+
+	// reviews
+	router.HandlerFunc(http.MethodGet, "/v1/movies/:id/reviews", app.listReviewsHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/movies/:id/reviews", app.requireActivatedUser(app.createReviewHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/reviews/:id", app.requireActivatedUser(app.updateReviewHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/reviews/:id", app.requireActivatedUser(app.deleteReviewHandler))
 
 	//actors
 	router.HandlerFunc(http.MethodPost, "/v1/actors", app.createActorsHandler)
-	router.HandlerFunc(http.MethodGet, "/v1/actors/:id", app.showActorsHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/actors/:id", app.paramSwitch(app.showActorsHandler, map[string]http.HandlerFunc{
+		"suggest": app.suggestHandler(app.models.Actors.Suggest),
+	}))
 
 	// trailers
 	router.HandlerFunc(http.MethodGet, "/v1/trailers", app.listTrailersHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/trailers", app.createTrailerHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/trailers/:id", app.paramSwitch(app.showTrailerHandler, map[string]http.HandlerFunc{
+		"suggest": app.suggestHandler(app.models.Trailers.Suggest),
+	}))
+	router.HandlerFunc(http.MethodGet, "/v1/trailers/:id/file", app.downloadTrailerFileHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/trailers/:id/file", app.requireActivatedUser(app.uploadTrailerFileHandler))
 
 	// users
 	//router.HandlerFunc(http.MethodGet, "/v1/trailers", app.listTrailersHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 
+	// watchlists
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/watchlists", app.requireActivatedUser(app.listWatchlistsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/watchlists", app.requireActivatedUser(app.createWatchlistHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/watchlists/:id", app.requireActivatedUser(app.showWatchlistHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me/watchlists/:id", app.requireActivatedUser(app.updateWatchlistHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/watchlists/:id", app.requireActivatedUser(app.deleteWatchlistHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/watchlists/:id/entries", app.requireActivatedUser(app.addWatchlistEntryHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me/watchlists/:id/entries/:movie_id", app.requireActivatedUser(app.updateWatchlistEntryHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/watchlists/:id/entries/:movie_id", app.requireActivatedUser(app.deleteWatchlistEntryHandler))
+
 	//tokens
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
 
-	// Wrap the router with the panic recovery middleware.
-	//return app.recoverPanic(app.authenticate(router))
-	return app.recoverPanic(app.rateLimit(app.authenticate(router)))
+	// change events
+	router.HandlerFunc(http.MethodGet, "/v1/events", app.requireActivatedUser(app.streamEventsHandler))
+
+	// batch requests
+	router.HandlerFunc(http.MethodPost, "/v1/batch", app.batchHandler)
+
+	// development-only debugging pages
+	if app.config.env == "development" {
+		router.HandlerFunc(http.MethodGet, "/debug/mail", app.debugMailHandler)
+	}
+
+	return router
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/asd/asd/internal/data"
+	"github.com/asd/asd/internal/validator"
+	"net/http"
+	"strings"
+)
+
+// suggestFunc looks up autocomplete suggestions, for example MovieModel.Suggest().
+type suggestFunc func(q string, limit int) ([]*data.Suggestion, error)
+
+// The suggestHandler() method returns a handler for the "GET .../suggest?q=" autocomplete
+// endpoints. The client can ask for up to 25 suggestions with ?limit=, the default
+// is 10.
+func (app *application) suggestHandler(fn suggestFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var input struct {
+			Q     string
+			Limit int
+		}
+		v := validator.New()
+		qs := r.URL.Query()
+
+		input.Q = app.readString(qs, "q", "")
+		input.Limit = app.readInt(qs, "limit", 10, v)
+
+		v.Check(input.Q != "", "q", "must be provided")
+		v.Check(len(input.Q) <= 100, "q", "must not be more than 100 bytes long")
+		v.Check(input.Limit > 0, "limit", "must be greater than zero")
+		v.Check(input.Limit <= 25, "limit", "must be a maximum of 25")
+		if !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		suggestions, err := fn(input.Q, input.Limit)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"suggestions": suggestions}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+	}
+}
+
+// descendingRelevance() rewrites a "relevance" key in a comma-separated sort value as
+// "-relevance", since the best match should always come first, and reports whether
+// the sort uses relevance at all.
+func descendingRelevance(sort string) (string, bool) {
+	keys := strings.Split(sort, ",")
+	for i, key := range keys {
+		if key == "relevance" {
+			keys[i] = "-relevance"
+		}
+	}
+	return strings.Join(keys, ","), validator.In("-relevance", keys...)
+}
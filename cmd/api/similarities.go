@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"github.com/asd/asd/internal/data"
+	"github.com/asd/asd/internal/validator"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// startSimilarityRefresher() rebuilds the similar movies table straight away and then
+// every interval. An interval of zero or less disables the refresher, leaving whatever
+// is already in the table.
+func (app *application) startSimilarityRefresher(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	app.runPeriodically(interval, app.refreshSimilarities)
+}
+
+// refreshSimilarities() runs a single refresh, logging the outcome.
+func (app *application) refreshSimilarities() {
+	start := time.Now()
+	pairs, err := app.models.Similarities.Refresh()
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"job": "similarity refresh"})
+		return
+	}
+	app.logger.PrintInfo("similar movies refreshed", map[string]string{
+		"pairs":    strconv.FormatInt(pairs, 10),
+		"duration": time.Since(start).String(),
+	})
+}
+
+// readScoredLimit() reads the ?limit= parameter of the similar movies and
+// recommendations endpoints, which defaults to 10 and is at most 50.
+func (app *application) readScoredLimit(r *http.Request, v *validator.Validator) int {
+	limit := app.readInt(r.URL.Query(), "limit", 10, v)
+
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 50, "limit", "must be a maximum of 50")
+	return limit
+}
+
+// The similarMoviesHandler() returns the movies most like the given one, from the
+// precomputed table, so a movie added since the last refresh has none yet.
+func (app *application) similarMoviesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	v := validator.New()
+	limit := app.readScoredLimit(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Look the movie up first, so an unknown ID is a 404 rather than an empty list.
+	_, err = app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	similar, err := app.models.Similarities.GetSimilar(id, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"similar": similar}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The recommendationsHandler() returns movies the current user hasn't rated or added
+// to a watchlist, ranked by how similar they are to the ones they have. A user with
+// no ratings or watchlist entries gets an empty list.
+func (app *application) recommendationsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	limit := app.readScoredLimit(r, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	recommendations, err := app.models.Similarities.GetRecommendations(app.contextGetUser(r).ID, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recommendations": recommendations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
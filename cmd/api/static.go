@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/asd/asd/internal/storage"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The serveBlobHandler() serves stored blobs (uploaded artwork) under /v1/static/.
+// Blob keys contain a hash of their contents, so the responses can be cached
+// indefinitely. http.ServeContent() takes care of conditional and range requests.
+func (app *application) serveBlobHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(httprouter.ParamsFromContext(r.Context()).ByName("filepath"), "/")
+
+	blob, err := app.blobs.Open(key)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotExist):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, blob.ModTime.UnixNano(), blob.Size))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	http.ServeContent(w, r, key, blob.ModTime, blob)
+}
@@ -1,9 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/asd/asd/internal/data"
+	"github.com/asd/asd/internal/storage"
 	"github.com/asd/asd/internal/validator"
+	"hash"
+	"io"
 	"net/http"
+	"strings"
+	"time"
 )
 
 // Add a createMovieHandler for the "POST /v1/movies" endpoint.
@@ -14,6 +25,7 @@ func (app *application) createTrailerHandler(w http.ResponseWriter, r *http.Requ
 	// of the Movie struct that we created earlier). This struct will be our *target
 	// decode destination*.
 	var input struct {
+		MovieID     int64  `json:"movie_id"`
 		TrailerName string `json:"trailer_name"`
 		Duration    int32  `json:"duration"`
 		PremierDate string `json:"premier_date"`
@@ -22,9 +34,28 @@ func (app *application) createTrailerHandler(w http.ResponseWriter, r *http.Requ
 	err := app.readJSON(w, r, &input) //non-nil pointer as the target decode destination
 	if err != nil {
 		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// A trailer can optionally be linked to a movie, so that it can be embedded in the
+	// movie's responses with ?include=trailers.
+	if input.MovieID != 0 {
+		_, err = app.models.Movies.Get(input.MovieID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v := validator.New()
+				v.AddError("movie_id", "movie does not exist")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
 	}
 
 	trailer := &data.Trailer{
+		MovieID:     input.MovieID,
 		TrailerName: input.TrailerName,
 		Duration:    input.Duration,
 		PremierDate: input.PremierDate,
@@ -50,6 +81,7 @@ func (app *application) listTrailersHandler(w http.ResponseWriter, r *http.Reque
 	var input struct {
 		TrailerName string
 		data.Filters
+		data.Fields
 	}
 	// Initialize a new Validator instance.
 	v := validator.New()
@@ -62,8 +94,15 @@ func (app *application) listTrailersHandler(w http.ResponseWriter, r *http.Reque
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{"id", "trailer_name", "duration", "premier_date", "-id", "-trailer_name", "-duration", "-premier_date"}
+	input.Filters.SortSafelist = []string{"id", "trailer_name", "duration", "premier_date", "relevance", "-id", "-trailer_name", "-duration", "-premier_date", "-relevance"}
+	var byRelevance bool
+	input.Filters.Sort, byRelevance = descendingRelevance(input.Filters.Sort)
+	v.Check(!byRelevance || input.TrailerName != "", "sort", "relevance can only be used with a trailer_name search")
 
+	// Trailers have no related resources to embed, so only ?fields= is accepted.
+	input.Fields = app.readFields(qs, []string{"id", "movie_id", "trailer_name", "duration", "premier_date", "version", "file_size", "file_type", "file_sha256", "relevance"}, nil)
+
+	data.ValidateFields(v, input.Fields)
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
@@ -75,8 +114,224 @@ func (app *application) listTrailersHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"trailers": trailers}, nil)
+	shaped := make([]map[string]interface{}, 0, len(trailers))
+	for _, trailer := range trailers {
+		t, err := project(trailer, input.Fields.Fields)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		shaped = append(shaped, t)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"trailers": shaped}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showTrailerHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	trailer, err := app.models.Trailers.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"trailer": trailer}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+const (
+	trailerFileMaxBytes = 1 << 30
+	// Uploading or downloading a large video takes longer than the server's read and
+	// write timeouts allow, so they're extended for these requests.
+	trailerFileTimeout = 30 * time.Minute
+)
+
+// trailerFileTypes maps the video formats accepted for trailers to the file extension
+// they're stored with.
+var trailerFileTypes = map[string]string{
+	"video/mp4":  ".mp4",
+	"video/webm": ".webm",
+}
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumReader hashes everything read through it. At the end of the stream it
+// returns errChecksumMismatch instead of io.EOF if the SHA-256 isn't the expected one,
+// so the blob store discards the upload rather than saving it.
+type checksumReader struct {
+	r    io.Reader
+	hash hash.Hash
+	want []byte
+	n    int64
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	c.n += int64(n)
+	if err == io.EOF && !bytes.Equal(c.hash.Sum(nil), c.want) {
+		return n, errChecksumMismatch
+	}
+	return n, err
+}
+
+// The uploadTrailerFileHandler() stores the request body as the trailer's video file.
+// The body is the raw file (not a multipart form), and is streamed to storage rather
+// than held in memory. The client must send the hex SHA-256 of the file in the
+// X-Checksum-Sha256 header; if the received file doesn't match, it's discarded.
+func (app *application) uploadTrailerFileHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	trailer, err := app.models.Trailers.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+	checksum := strings.ToLower(r.Header.Get("X-Checksum-Sha256"))
+	want, err := hex.DecodeString(checksum)
+	v.Check(err == nil && len(want) == sha256.Size, "checksum", "X-Checksum-Sha256 header must contain the hex SHA-256 of the file")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	extendDeadlines(w, trailerFileTimeout)
+
+	body := bufio.NewReaderSize(http.MaxBytesReader(w, r.Body, trailerFileMaxBytes), 512)
+
+	// The format is sniffed from the start of the file; the Content-Type header
+	// isn't trusted.
+	head, err := body.Peek(512)
+	if len(head) == 0 {
+		app.badRequestResponse(w, r, errors.New("body must not be empty"))
+		return
+	}
+	contentType := http.DetectContentType(head)
+	ext, ok := trailerFileTypes[contentType]
+	v.Check(ok, "file", "must be an MP4 or WebM video")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	reader := &checksumReader{r: body, hash: sha256.New(), want: want}
+	key := fmt.Sprintf("trailers/%d/%s%s", trailer.ID, checksum, ext)
+
+	err = app.blobs.Put(key, reader)
+	if err != nil {
+		switch {
+		case errors.Is(err, errChecksumMismatch):
+			v.AddError("checksum", "does not match the uploaded file")
+			app.failedValidationResponse(w, r, v.Errors)
+		case err.Error() == "http: request body too large":
+			app.badRequestResponse(w, r, fmt.Errorf("body must not be larger than %d bytes", trailerFileMaxBytes))
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	trailer.FileKey = key
+	trailer.FileSize = reader.n
+	trailer.FileType = contentType
+	trailer.FileSHA256 = checksum
+
+	oldKey, err := app.models.Trailers.SetFile(trailer)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// As with artwork, a file left behind by a failed delete is only logged.
+	if oldKey != "" && oldKey != key {
+		err = app.blobs.Delete(oldKey)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"trailer": trailer}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The downloadTrailerFileHandler() serves the trailer's video file. http.ServeContent()
+// answers Range requests with 206 Partial Content (so browsers can seek), sets
+// Accept-Ranges, and handles the conditional headers against the ETag, which is the
+// file's SHA-256.
+func (app *application) downloadTrailerFileHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	trailer, err := app.models.Trailers.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if trailer.FileKey == "" {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	blob, err := app.blobs.Open(trailer.FileKey)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotExist):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer blob.Close()
+
+	extendDeadlines(w, trailerFileTimeout)
+
+	// The URL stays the same when a new file is uploaded, so caches must revalidate.
+	w.Header().Set("Content-Type", trailer.FileType)
+	w.Header().Set("ETag", `"`+trailer.FileSHA256+`"`)
+	w.Header().Set("Cache-Control", "public, no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	http.ServeContent(w, r, "", blob.ModTime, blob)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"github.com/asd/asd/internal/data"
+	"github.com/asd/asd/internal/validator"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// localizeMovies() replaces the movie titles with their translations for the locales
+// in the request's Accept-Language header, and returns the headers to send with the
+// response: Vary always, and Content-Language when a translation was used.
+func (app *application) localizeMovies(r *http.Request, movies []*data.Movie) (http.Header, error) {
+	headers := make(http.Header)
+	headers.Set("Vary", "Accept-Language")
+
+	used, err := app.models.Translations.Localize(movies, requestLocales(r))
+	if err != nil {
+		return nil, err
+	}
+	if len(used) > 0 {
+		headers.Set("Content-Language", strings.Join(used, ", "))
+	}
+	return headers, nil
+}
+
+// getMovieForTranslation() loads the movie named in the URL. If it doesn't exist an
+// error response has already been sent and nil is returned.
+func (app *application) getMovieForTranslation(w http.ResponseWriter, r *http.Request) *data.Movie {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+
+	movie, err := app.models.Movies.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return movie
+}
+
+func (app *application) listTranslationsHandler(w http.ResponseWriter, r *http.Request) {
+	movie := app.getMovieForTranslation(w, r)
+	if movie == nil {
+		return
+	}
+
+	translations, err := app.models.Translations.GetAllForMovie(movie.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"translations": translations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The putTranslationHandler() creates or replaces the translation of a movie for the
+// locale in the URL, responding with 201 Created for a new translation.
+func (app *application) putTranslationHandler(w http.ResponseWriter, r *http.Request) {
+	movie := app.getMovieForTranslation(w, r)
+	if movie == nil {
+		return
+	}
+
+	var input struct {
+		Title    string `json:"title"`
+		Synopsis string `json:"synopsis"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	translation := &data.MovieTranslation{
+		MovieID:  movie.ID,
+		Locale:   strings.ToLower(httprouter.ParamsFromContext(r.Context()).ByName("locale")),
+		Title:    input.Title,
+		Synopsis: input.Synopsis,
+	}
+
+	v := validator.New()
+	if data.ValidateTranslation(v, translation); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	created, err := app.models.Translations.Upsert(translation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	err = app.writeJSON(w, status, envelope{"translation": translation}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteTranslationHandler(w http.ResponseWriter, r *http.Request) {
+	movie := app.getMovieForTranslation(w, r)
+	if movie == nil {
+		return
+	}
+
+	locale := strings.ToLower(httprouter.ParamsFromContext(r.Context()).ByName("locale"))
+
+	err := app.models.Translations.Delete(movie.ID, locale)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "translation successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,10 +1,125 @@
 package data
 
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/asd/asd/internal/validator"
+	"github.com/lib/pq"
+	"time"
+)
+
 type Actor struct {
 	ID           int64    `json:"id"`
 	FirstName    string   `json:"firstName"`
 	LastName     string   `json:"lastName"`
 	DateOfBirth  int32    `json:"dateOfBirth,omitempty"`
 	MoviesCasted []string `json:"moviesCasted,omitempty"`
-	// time the movie information is updated
+	Version      int32    `json:"version"`
+}
+
+type ActorModel struct {
+	DB Handle
+}
+
+func ValidateActor(v *validator.Validator, actor *Actor) {
+	v.Check(actor.FirstName != "", "firstName", "must be provided")
+	v.Check(len(actor.FirstName) <= 100, "firstName", "must not be more than 100 bytes long")
+	v.Check(actor.LastName != "", "lastName", "must be provided")
+	v.Check(len(actor.LastName) <= 100, "lastName", "must not be more than 100 bytes long")
+	v.Check(actor.DateOfBirth >= 0, "dateOfBirth", "must not be negative")
+	v.Check(validator.Unique(actor.MoviesCasted), "moviesCasted", "must not contain duplicate values")
+}
+
+func (m ActorModel) Insert(actor *Actor) error {
+	query := `
+INSERT INTO actors (first_name, last_name, date_of_birth, movies_casted)
+VALUES ($1, $2, $3, $4)
+RETURNING id, version`
+	args := []interface{}{actor.FirstName, actor.LastName, actor.DateOfBirth, pq.Array(actor.MoviesCasted)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&actor.ID, &actor.Version)
+}
+
+func (m ActorModel) Get(id int64) (*Actor, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT id, first_name, last_name, date_of_birth, movies_casted, version
+FROM actors
+WHERE id = $1`
+
+	var actor Actor
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&actor.ID,
+		&actor.FirstName,
+		&actor.LastName,
+		&actor.DateOfBirth,
+		pq.Array(&actor.MoviesCasted),
+		&actor.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &actor, nil
+}
+
+// Suggest() returns up to limit actor names ("first last") for autocompletion.
+func (m ActorModel) Suggest(q string, limit int) ([]*Suggestion, error) {
+	return suggest(m.DB, "actors", "(first_name || ' ' || last_name)", "TRUE", q, limit)
+}
+
+// GetAllForMovies() returns the actors cast in each of the given movies, keyed by movie
+// title. Actors are linked to movies by the titles in their movies_casted list.
+func (m ActorModel) GetAllForMovies(titles []string) (map[string][]*Actor, error) {
+	query := `
+SELECT casted.title, id, first_name, last_name, date_of_birth, movies_casted, version
+FROM actors, unnest(movies_casted) AS casted(title)
+WHERE casted.title = ANY($1)
+ORDER BY last_name, first_name, id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(titles))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	actors := make(map[string][]*Actor)
+	for rows.Next() {
+		var title string
+		var actor Actor
+		err := rows.Scan(
+			&title,
+			&actor.ID,
+			&actor.FirstName,
+			&actor.LastName,
+			&actor.DateOfBirth,
+			pq.Array(&actor.MoviesCasted),
+			&actor.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		actors[title] = append(actors[title], &actor)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return actors, nil
 }
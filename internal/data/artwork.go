@@ -0,0 +1,68 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// StaticPathPrefix is the URL path under which the API serves stored blobs.
+const StaticPathPrefix = "/v1/static/"
+
+// Artwork is the blob key prefix of a movie image, for example "posters/12/1f2e3d4c".
+// Each variant of the image is stored below it as "<variant>.jpg".
+type Artwork string
+
+// URL() returns the URL path of one variant of the image, or "" if there's no image.
+func (a Artwork) URL(variant string) string {
+	if a == "" {
+		return ""
+	}
+	return StaticPathPrefix + string(a) + "/" + variant + ".jpg"
+}
+
+// MarshalJSON() encodes the artwork as the URL of the full size image. The smaller
+// variants are at the same URL with "original" replaced by the variant name.
+func (a Artwork) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(a.URL("original"))), nil
+}
+
+// SetArtwork() points the poster or backdrop of a movie at a new set of images, and
+// returns the previous value so that the caller can delete the old blobs. Changing
+// the artwork doesn't bump the movie's version.
+func (m MovieModel) SetArtwork(id int64, kind string, artwork Artwork) (Artwork, error) {
+	var column string
+	switch kind {
+	case "poster":
+		column = "poster"
+	case "backdrop":
+		column = "backdrop"
+	default:
+		return "", fmt.Errorf("unknown artwork kind %q", kind)
+	}
+
+	query := fmt.Sprintf(`
+UPDATE movies
+SET %[1]s = $1
+FROM (SELECT id, %[1]s FROM movies WHERE id = $2 FOR UPDATE) AS old
+WHERE movies.id = old.id AND movies.deleted_at IS NULL
+RETURNING old.%[1]s`, column)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var old Artwork
+	err := m.DB.QueryRowContext(ctx, query, artwork, id).Scan(&old)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+	return old, nil
+}
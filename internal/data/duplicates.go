@@ -0,0 +1,353 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"time"
+)
+
+// DuplicateRuntimeTolerance is how many minutes the runtimes of two movies with the same
+// title and year may differ by for them to still be treated as the same film. Listings
+// often disagree by a few minutes (credits, regional cuts).
+const DuplicateRuntimeTolerance = 5
+
+// normalizedTitle() returns the SQL expression for the title used by duplicate checks:
+// lower case with everything but letters and digits removed, so "Blade Runner",
+// "blade runner" and "Blade-Runner!" all compare equal. The expression matches the
+// movies_normalized_title_idx index.
+func normalizedTitle(expr string) string {
+	return `regexp_replace(lower(` + expr + `), '[^[:alnum:]]+', '', 'g')`
+}
+
+// duplicateLock() returns the SQL expression for the advisory lock key of a title and
+// year. Every movie that could be a duplicate of another shares its key, so taking the
+// lock with pg_advisory_xact_lock() serializes the duplicate check and insert.
+func duplicateLock(title, year string) string {
+	return `hashtext(` + normalizedTitle(title) + ` || ':' || ` + year + `)`
+}
+
+// A BatchDuplicate is a movie which InsertBatch() skipped because it looks like the
+// existing movies in MovieIDs, or like the earlier movies of the same batch at the
+// indexes in Earlier.
+type BatchDuplicate struct {
+	MovieIDs []int64
+	Earlier  []int
+}
+
+// A DuplicatePair is two movies in the trash-free catalog which look like the same film.
+// Movie is always the older record (the lower ID).
+type DuplicatePair struct {
+	Movie     *Movie `json:"movie"`
+	Duplicate *Movie `json:"duplicate"`
+}
+
+// MergeResult counts what Merge() moved from the source movie to the target.
+type MergeResult struct {
+	Trailers         int64 `json:"trailers"`
+	Reviews          int64 `json:"reviews"`
+	Cast             int64 `json:"cast"`
+	WatchlistEntries int64 `json:"watchlist_entries"`
+	Translations     int64 `json:"translations"`
+}
+
+// FindDuplicates() returns the movies that look like the same film as the given one:
+// the same normalized title and year, and a runtime within DuplicateRuntimeTolerance.
+// The movie itself (if it's been saved) is never included.
+func (m MovieModel) FindDuplicates(movie *Movie) ([]*Movie, error) {
+	query := `
+SELECT id, created_at, title, year, runtime, genres, version
+FROM movies
+WHERE ` + normalizedTitle("title") + ` = ` + normalizedTitle("$1") + `
+AND year = $2
+AND abs(runtime - $3) <= $4
+AND id <> $5
+AND deleted_at IS NULL
+ORDER BY id ASC`
+
+	args := []interface{}{movie.Title, movie.Year, movie.Runtime, DuplicateRuntimeTolerance, movie.ID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := []*Movie{}
+	for rows.Next() {
+		var movie Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		movies = append(movies, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return movies, nil
+}
+
+// findBatchDuplicates() locks the titles of a batch of movies and then returns the
+// movies in it which duplicate an existing movie or an earlier one in the batch, keyed by
+// their index.
+func findBatchDuplicates(ctx context.Context, tx Tx, movies []*Movie) (map[int]*BatchDuplicate, error) {
+	titles := make([]string, len(movies))
+	years := make([]int32, len(movies))
+	runtimes := make([]int32, len(movies))
+	for i, movie := range movies {
+		titles[i], years[i], runtimes[i] = movie.Title, movie.Year, int32(movie.Runtime)
+	}
+
+	// Locks are taken in key order, so that two batches can't deadlock.
+	_, err := tx.ExecContext(ctx, `
+SELECT pg_advisory_xact_lock(k)
+FROM (
+	SELECT DISTINCT `+duplicateLock("title", "year")+` AS k
+	FROM unnest($1::text[], $2::integer[]) AS b(title, year)
+	ORDER BY k
+) AS keys`, pq.Array(titles), pq.Array(years))
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+WITH batch AS (
+	SELECT title, year, runtime, n - 1 AS i
+	FROM unnest($1::text[], $2::integer[], $3::integer[]) WITH ORDINALITY AS b(title, year, runtime, n)
+)
+SELECT b.i, m.id, -1
+FROM batch b
+JOIN movies m ON ` + normalizedTitle("m.title") + ` = ` + normalizedTitle("b.title") + `
+	AND m.year = b.year AND abs(m.runtime - b.runtime) <= $4 AND m.deleted_at IS NULL
+UNION ALL
+SELECT b.i, 0, e.i
+FROM batch b
+JOIN batch e ON e.i < b.i AND ` + normalizedTitle("e.title") + ` = ` + normalizedTitle("b.title") + `
+	AND e.year = b.year AND abs(e.runtime - b.runtime) <= $4
+ORDER BY 1, 2, 3`
+
+	rows, err := tx.QueryContext(ctx, query, pq.Array(titles), pq.Array(years), pq.Array(runtimes), DuplicateRuntimeTolerance)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	duplicates := map[int]*BatchDuplicate{}
+	for rows.Next() {
+		var i, earlier int
+		var movieID int64
+		err := rows.Scan(&i, &movieID, &earlier)
+		if err != nil {
+			return nil, err
+		}
+		if duplicates[i] == nil {
+			duplicates[i] = &BatchDuplicate{}
+		}
+		if earlier >= 0 {
+			duplicates[i].Earlier = append(duplicates[i].Earlier, earlier)
+		} else {
+			duplicates[i].MovieIDs = append(duplicates[i].MovieIDs, movieID)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return duplicates, nil
+}
+
+// LockDuplicates() takes the advisory lock shared by every movie which could be a
+// duplicate of the given one, until the end of the transaction. Called at the start of
+// a transaction which checks FindDuplicates() and then inserts, it stops two concurrent
+// inserts of the same film from both passing the check. Outside a transaction the lock
+// is released straight away.
+func (m MovieModel) LockDuplicates(movie *Movie) error {
+	query := `SELECT pg_advisory_xact_lock(` + duplicateLock("$1::text", "$2::integer") + `)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, movie.Title, movie.Year)
+	return err
+}
+
+// GetDuplicates() returns a page of every pair of movies which FindDuplicates() would
+// match, ordered by the older movie of each pair. Three copies of a film show up as
+// three pairs.
+func (m MovieModel) GetDuplicates(filters Filters) ([]*DuplicatePair, Metadata, error) {
+	query := `
+SELECT count(*) OVER(),
+    a.id, a.created_at, a.title, a.year, a.runtime, a.genres, a.version,
+    b.id, b.created_at, b.title, b.year, b.runtime, b.genres, b.version
+FROM movies a
+INNER JOIN movies b ON ` + normalizedTitle("b.title") + ` = ` + normalizedTitle("a.title") + `
+    AND b.year = a.year
+    AND abs(b.runtime - a.runtime) <= $1
+    AND b.id > a.id
+WHERE a.deleted_at IS NULL AND b.deleted_at IS NULL
+ORDER BY a.id ASC, b.id ASC
+LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, DuplicateRuntimeTolerance, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	pairs := []*DuplicatePair{}
+
+	for rows.Next() {
+		pair := DuplicatePair{Movie: &Movie{}, Duplicate: &Movie{}}
+		err := rows.Scan(
+			&totalRecords,
+			&pair.Movie.ID,
+			&pair.Movie.CreatedAt,
+			&pair.Movie.Title,
+			&pair.Movie.Year,
+			&pair.Movie.Runtime,
+			pq.Array(&pair.Movie.Genres),
+			&pair.Movie.Version,
+			&pair.Duplicate.ID,
+			&pair.Duplicate.CreatedAt,
+			&pair.Duplicate.Title,
+			&pair.Duplicate.Year,
+			&pair.Duplicate.Runtime,
+			pq.Array(&pair.Duplicate.Genres),
+			&pair.Duplicate.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		pairs = append(pairs, &pair)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return pairs, metadata, nil
+}
+
+// Merge() folds the source movie into the target and moves the source to the trash, all
+// in one transaction. Trailers move across, as do reviews, watchlist entries and
+// translations, except where the target already has one from the same user, on the
+// same watchlist or in the same locale; in that case the target's is kept. Actors cast
+// in the source are recast in the target.
+//
+// ErrEditConflict is returned if the source has been edited since it was read, or if
+// either movie has been moved to the trash in the meantime.
+func (m MovieModel) Merge(source, target *Movie) (*MergeResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the target so it can't be trashed while things are being moved onto it.
+	var id int64
+	err = tx.QueryRowContext(ctx, `SELECT id FROM movies WHERE id = $1 AND deleted_at IS NULL FOR SHARE`, target.ID).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrEditConflict
+		default:
+			return nil, err
+		}
+	}
+
+	var result MergeResult
+
+	statements := []struct {
+		query string
+		count *int64
+	}{
+		{
+			`UPDATE trailers SET movie_id = $2 WHERE movie_id = $1`,
+			&result.Trailers,
+		},
+		{
+			`UPDATE reviews SET movie_id = $2
+WHERE movie_id = $1 AND user_id NOT IN (SELECT user_id FROM reviews WHERE movie_id = $2)`,
+			&result.Reviews,
+		},
+		{
+			`UPDATE watchlist_entries SET movie_id = $2
+WHERE movie_id = $1 AND watchlist_id NOT IN (SELECT watchlist_id FROM watchlist_entries WHERE movie_id = $2)`,
+			&result.WatchlistEntries,
+		},
+		{
+			`UPDATE movie_translations SET movie_id = $2
+WHERE movie_id = $1 AND locale NOT IN (SELECT locale FROM movie_translations WHERE movie_id = $2)`,
+			&result.Translations,
+		},
+	}
+	for _, statement := range statements {
+		rows, err := tx.ExecContext(ctx, statement.query, source.ID, target.ID)
+		if err != nil {
+			return nil, err
+		}
+		*statement.count, err = rows.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Actors are linked to movies by title, so the cast only needs to change when the
+	// two titles differ.
+	if source.Title != target.Title {
+		rows, err := tx.ExecContext(ctx, `
+UPDATE actors
+SET movies_casted = CASE WHEN $2 = ANY(movies_casted) THEN array_remove(movies_casted, $1) ELSE array_replace(movies_casted, $1, $2) END,
+    version = version + 1
+WHERE $1 = ANY(movies_casted)`, source.Title, target.Title)
+		if err != nil {
+			return nil, err
+		}
+		result.Cast, err = rows.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Whatever is left on the source (reviews and entries the target already had) goes
+	// to the trash with it, and the watchlist entries are removed as Delete() does.
+	rows, err := tx.ExecContext(ctx, `
+UPDATE movies
+SET deleted_at = NOW()
+WHERE id = $1 AND version = $2 AND deleted_at IS NULL`, source.ID, source.Version)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := rows.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, ErrEditConflict
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM watchlist_entries WHERE movie_id = $1`, source.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &result, tx.Commit()
+}
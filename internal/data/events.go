@@ -0,0 +1,113 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// An Event is an entry in the change log which database triggers write for every change
+// to movies and trailers, for example "movie.updated". Events with a Permission are
+// only shown to users who have it.
+type Event struct {
+	ID         int64           `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Type       string          `json:"type"`
+	Permission string          `json:"-"`
+	Payload    json.RawMessage `json:"data"`
+}
+
+// EventsChannel is the Postgres NOTIFY channel on which the ID of each new event is
+// announced.
+const EventsChannel = "events"
+
+// settledEventSQL matches the events which can safely be read in ID order. An event's
+// ID is taken from the sequence before its transaction commits, so a transaction
+// holding a lower ID can commit after one holding a higher ID; a reader that had moved
+// past the higher ID would never see the lower one. Events written by a transaction
+// older than every transaction still in progress (the snapshot's xmin) can't be
+// overtaken like that, so only those are read. Newer events are held back until the
+// transactions before them have finished.
+const settledEventSQL = `txid < txid_snapshot_xmin(txid_current_snapshot())`
+
+type EventModel struct {
+	DB Handle
+}
+
+// LatestID() returns the ID of the newest settled event (see settledEventSQL), or zero
+// if there are none.
+func (m EventModel) LatestID() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int64
+	err := m.DB.QueryRowContext(ctx, `SELECT COALESCE(max(id), 0) FROM events WHERE `+settledEventSQL).Scan(&id)
+	return id, err
+}
+
+// GetAfter() returns up to limit settled events (see settledEventSQL) with an ID greater
+// than the given one, oldest first. As no unsettled event is returned, a client can
+// always carry on from the last ID it was given.
+func (m EventModel) GetAfter(id int64, limit int) ([]*Event, error) {
+	query := `
+SELECT id, created_at, type, permission, payload
+FROM events
+WHERE id > $1 AND ` + settledEventSQL + `
+ORDER BY id ASC
+LIMIT $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*Event{}
+	for rows.Next() {
+		var event Event
+		err := rows.Scan(
+			&event.ID,
+			&event.CreatedAt,
+			&event.Type,
+			&event.Permission,
+			&event.Payload,
+		)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// HeldBackAfter() reports whether there are committed events with an ID greater than
+// the given one which GetAfter() isn't returning yet, because they aren't settled.
+func (m EventModel) HeldBackAfter(id int64) (bool, error) {
+	query := `SELECT EXISTS (SELECT 1 FROM events WHERE id > $1 AND NOT (` + settledEventSQL + `))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var held bool
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&held)
+	return held, err
+}
+
+// DeleteOlderThan() removes the events older than the retention period, and returns the
+// number of events removed. Clients can't resume from before that point.
+func (m EventModel) DeleteOlderThan(retention time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM events WHERE created_at < $1`, time.Now().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,30 @@
+package data
+
+import (
+	"github.com/asd/asd/internal/validator"
+)
+
+// Fields holds the ?fields= and ?include= query string parameters of a request. Like
+// the Sort field of Filters, both are checked against a per-resource safelist.
+type Fields struct {
+	Fields          []string
+	FieldSafelist   []string
+	Include         []string
+	IncludeSafelist []string
+}
+
+// Includes() reports whether the related resource name was asked for with ?include=.
+func (f Fields) Includes(name string) bool {
+	return validator.In(name, f.Include...)
+}
+
+func ValidateFields(v *validator.Validator, f Fields) {
+	for _, field := range f.Fields {
+		v.Check(validator.In(field, f.FieldSafelist...), "fields", "invalid field: "+field)
+	}
+	for _, include := range f.Include {
+		v.Check(validator.In(include, f.IncludeSafelist...), "include", "invalid include value: "+include)
+	}
+	v.Check(validator.Unique(f.Fields), "fields", "must not contain duplicate values")
+	v.Check(validator.Unique(f.Include), "include", "must not contain duplicate values")
+}
@@ -1,11 +1,17 @@
 package data
 
 import (
+	"errors"
+	"fmt"
 	"github.com/asd/asd/internal/validator"
 	"math"
 	"strings"
 )
 
+// ErrInvalidSort is returned when a query is built from a sort key that isn't in the
+// safelist.
+var ErrInvalidSort = errors.New("invalid sort value")
+
 type Filters struct {
 	Page         int
 	PageSize     int
@@ -13,25 +19,40 @@ type Filters struct {
 	SortSafelist []string
 }
 
-// Check that the client-provided Sort field matches one of the entries in our safelist
-// and if it does, extract the column name from the Sort field by stripping the leading
-// hyphen character (if one exists).
-func (f Filters) sortColumn() string {
-	for _, safeValue := range f.SortSafelist {
-		if f.Sort == safeValue {
-			return strings.TrimPrefix(f.Sort, "-")
+// sortKeys() splits the Sort field into its comma-separated keys, for example
+// "-year,title" into "-year" and "title".
+func (f Filters) sortKeys() []string {
+	return strings.Split(f.Sort, ",")
+}
+
+// orderBy() builds the ORDER BY list for the Sort field, so "-year,title" becomes
+// "year DESC, title ASC, id ASC". The id column is added as a final tie-breaker (unless
+// it's already there) so that rows with equal sort values keep the same order from one
+// page to the next. Every key must match an entry in SortSafelist. ValidateFilters()
+// checks this before the query is built, so an error here means that step was
+// skipped; the value is never put in the SQL.
+func (f Filters) orderBy() (string, error) {
+	var clauses []string
+	hasID := false
+
+	for _, key := range f.sortKeys() {
+		if !validator.In(key, f.SortSafelist...) {
+			return "", fmt.Errorf("%w: %q", ErrInvalidSort, key)
 		}
+
+		column := strings.TrimPrefix(key, "-")
+		direction := "ASC"
+		if strings.HasPrefix(key, "-") {
+			direction = "DESC"
+		}
+		clauses = append(clauses, column+" "+direction)
+		hasID = hasID || column == "id"
 	}
-	panic("unsafe sort parameter: " + f.Sort)
-}
 
-// Return the sort direction ("ASC" or "DESC") depending on the prefix character of the
-// Sort field.
-func (f Filters) sortDirection() string {
-	if strings.HasPrefix(f.Sort, "-") {
-		return "DESC"
+	if !hasID {
+		clauses = append(clauses, "id ASC")
 	}
-	return "ASC"
+	return strings.Join(clauses, ", "), nil
 }
 
 func (f Filters) limit() int {
@@ -48,8 +69,15 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 
 	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
-	// Check that the sort parameter matches a value in the safelist.
-	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+	// Check that each of the comma-separated sort keys matches a value in the
+	// safelist, and that no column is sorted on twice.
+	keys := f.sortKeys()
+	columns := make([]string, 0, len(keys))
+	for _, key := range keys {
+		v.Check(validator.In(key, f.SortSafelist...), "sort", "invalid sort value: "+key)
+		columns = append(columns, strings.TrimPrefix(key, "-"))
+	}
+	v.Check(validator.Unique(columns), "sort", "must not sort on the same column more than once")
 }
 
 type Metadata struct {
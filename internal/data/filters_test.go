@@ -0,0 +1,64 @@
+package data
+
+import (
+	"errors"
+	"github.com/asd/asd/internal/validator"
+	"testing"
+)
+
+var testSortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+
+func TestFiltersOrderBy(t *testing.T) {
+	tests := []struct {
+		sort    string
+		want    string
+		wantErr bool
+	}{
+		{sort: "id", want: "id ASC"},
+		{sort: "-id", want: "id DESC"},
+		{sort: "title", want: "title ASC, id ASC"},
+		{sort: "-year,title", want: "year DESC, title ASC, id ASC"},
+		{sort: "-year,-id,title", want: "year DESC, id DESC, title ASC"},
+		{sort: "year;DROP TABLE movies", wantErr: true},
+		{sort: "year,rating", wantErr: true},
+		{sort: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		f := Filters{Sort: tt.sort, SortSafelist: testSortSafelist}
+		got, err := f.orderBy()
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidSort) {
+				t.Errorf("orderBy(%q) error = %v; want ErrInvalidSort", tt.sort, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("orderBy(%q) unexpected error: %v", tt.sort, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("orderBy(%q) = %q; want %q", tt.sort, got, tt.want)
+		}
+	}
+}
+
+func TestValidateFiltersSort(t *testing.T) {
+	tests := []struct {
+		sort  string
+		valid bool
+	}{
+		{sort: "-year,title", valid: true},
+		{sort: "year,rating", valid: false},
+		{sort: "year,-year", valid: false},
+		{sort: "title,title", valid: false},
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+		ValidateFilters(v, Filters{Page: 1, PageSize: 20, Sort: tt.sort, SortSafelist: testSortSafelist})
+		if v.Valid() != tt.valid {
+			t.Errorf("ValidateFilters(sort=%q) valid = %t; want %t (errors: %v)", tt.sort, v.Valid(), tt.valid, v.Errors)
+		}
+	}
+}
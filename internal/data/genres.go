@@ -0,0 +1,333 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/asd/asd/internal/validator"
+	"github.com/lib/pq"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	ErrDuplicateGenre = errors.New("duplicate genre")
+)
+
+// A Genre is an entry in the genre taxonomy. Movies store genres by slug. The aliases
+// are other spellings ("science fiction", "scifi") that are mapped to the slug when a
+// movie is saved.
+type Genre struct {
+	ID         int64    `json:"id"`
+	Slug       string   `json:"slug"`
+	Name       string   `json:"name"`
+	Aliases    []string `json:"aliases"`
+	MovieCount int64    `json:"movie_count"`
+	Version    int32    `json:"version"`
+}
+
+type GenreModel struct {
+	DB Handle
+}
+
+var slugRX = regexp.MustCompile("[^a-z0-9]+")
+
+// Slugify() turns a genre name into its slug: lower case, with every run of other
+// characters replaced by a single hyphen, so "Sci-Fi", "sci fi" and "SCI_FI" all
+// become "sci-fi". The genres migration uses the same rule in SQL.
+func Slugify(s string) string {
+	return strings.Trim(slugRX.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+// GenreLookup maps the slugified slug, name and aliases of every genre to the genre's
+// slug.
+type GenreLookup map[string]string
+
+// Normalize() returns the slug of the genre that s names, and false if it isn't in
+// the taxonomy.
+func (l GenreLookup) Normalize(s string) (string, bool) {
+	slug, ok := l[Slugify(s)]
+	return slug, ok
+}
+
+// Except() returns a copy of the lookup without the names of the genre with the given
+// slug. It's used when validating a change to that genre against all the others.
+func (l GenreLookup) Except(slug string) GenreLookup {
+	others := make(GenreLookup, len(l))
+	for name, s := range l {
+		if s != slug {
+			others[name] = s
+		}
+	}
+	return others
+}
+
+// ValidateGenre() checks a genre before it's saved. The lookup should hold the other
+// genres in the taxonomy, so that none of the names of this genre can be mapped to
+// two different slugs.
+func ValidateGenre(v *validator.Validator, genre *Genre, others GenreLookup) {
+	v.Check(genre.Slug != "", "slug", "must be provided")
+	v.Check(genre.Slug == Slugify(genre.Slug), "slug", "must contain only lower case letters, digits and single hyphens")
+	v.Check(len(genre.Slug) <= 100, "slug", "must not be more than 100 bytes long")
+	v.Check(genre.Name != "", "name", "must be provided")
+	v.Check(len(genre.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(genre.Aliases) <= 20, "aliases", "must not contain more than 20 aliases")
+	v.Check(validator.Unique(genre.Aliases), "aliases", "must not contain duplicate values")
+
+	for _, name := range append([]string{genre.Slug, genre.Name}, genre.Aliases...) {
+		v.Check(Slugify(name) != "", "aliases", "must not contain empty values")
+		if slug, ok := others.Normalize(name); ok {
+			v.AddError("aliases", fmt.Sprintf("%q is already used by the %s genre", name, slug))
+		}
+	}
+}
+
+// Lookup() loads the whole taxonomy as a GenreLookup.
+func (m GenreModel) Lookup() (GenreLookup, error) {
+	query := `
+SELECT slug, name, aliases
+FROM genres`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lookup := GenreLookup{}
+	for rows.Next() {
+		var slug, name string
+		var aliases []string
+		err := rows.Scan(&slug, &name, pq.Array(&aliases))
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range append([]string{slug, name}, aliases...) {
+			lookup[Slugify(s)] = slug
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return lookup, nil
+}
+
+func (m GenreModel) Insert(genre *Genre) error {
+	query := `
+INSERT INTO genres (slug, name, aliases)
+VALUES ($1, $2, $3)
+RETURNING id, version`
+	args := []interface{}{genre.Slug, genre.Name, pq.Array(genre.Aliases)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&genre.ID, &genre.Version)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.As(err, &pqErr) && pqErr.Constraint == "genres_slug_key":
+			return ErrDuplicateGenre
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// genreMovieCountSQL counts the movies (outside the trash) tagged with a genre.
+const genreMovieCountSQL = `(SELECT count(*) FROM movies WHERE genres.slug = ANY(movies.genres) AND movies.deleted_at IS NULL)`
+
+func (m GenreModel) Get(id int64) (*Genre, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT id, slug, name, aliases, version, ` + genreMovieCountSQL + `
+FROM genres
+WHERE id = $1`
+
+	var genre Genre
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&genre.ID,
+		&genre.Slug,
+		&genre.Name,
+		pq.Array(&genre.Aliases),
+		&genre.Version,
+		&genre.MovieCount,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &genre, nil
+}
+
+// GetAll() returns the whole taxonomy in name order. There are only ever a few dozen
+// genres, so it isn't paginated.
+func (m GenreModel) GetAll() ([]*Genre, error) {
+	query := `
+SELECT id, slug, name, aliases, version, ` + genreMovieCountSQL + `
+FROM genres
+ORDER BY name ASC, id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	genres := []*Genre{}
+	for rows.Next() {
+		var genre Genre
+		err := rows.Scan(
+			&genre.ID,
+			&genre.Slug,
+			&genre.Name,
+			pq.Array(&genre.Aliases),
+			&genre.Version,
+			&genre.MovieCount,
+		)
+		if err != nil {
+			return nil, err
+		}
+		genres = append(genres, &genre)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return genres, nil
+}
+
+// retagSQL rewrites the genres of every movie tagged with $1 using the given SET
+// expression. Each retagged movie gets a new version and a revision credited to the
+// editor in $3, so a concurrent edit made against the old version fails with an edit
+// conflict instead of writing the old slug back.
+const retagSQL = `
+WITH retagged AS (
+    UPDATE movies
+    SET genres = %s, version = version + 1
+    WHERE $1 = ANY(genres)
+    RETURNING id, version, title, year, runtime, genres
+)
+INSERT INTO movie_revisions (movie_id, version, title, year, runtime, genres, editor_id)
+SELECT id, version, title, year, runtime, genres, $3
+FROM retagged`
+
+// Update() saves a genre. If the slug has changed from oldSlug, the movies tagged with
+// the old slug are retagged in the same transaction, as an edit by editorID (0 for
+// the anonymous user).
+func (m GenreModel) Update(genre *Genre, oldSlug string, editorID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+UPDATE genres
+SET slug = $1, name = $2, aliases = $3, version = version + 1
+WHERE id = $4 AND version = $5
+RETURNING version`
+	args := []interface{}{genre.Slug, genre.Name, pq.Array(genre.Aliases), genre.ID, genre.Version}
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&genre.Version)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.As(err, &pqErr) && pqErr.Constraint == "genres_slug_key":
+			return ErrDuplicateGenre
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	if genre.Slug != oldSlug {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(retagSQL, `array_replace(genres, $1, $2)`), oldSlug, genre.Slug, nullEditor(editorID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Merge() folds the source genre into the target: movies tagged with the source are
+// retagged with the target (once, if they already had both), the source's slug, name
+// and aliases become aliases of the target, and the source is deleted. The retagging is
+// recorded as an edit by editorID, as in Update().
+func (m GenreModel) Merge(source, target *Genre, editorID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	retag := `CASE WHEN $2 = ANY(genres) THEN array_remove(genres, $1) ELSE array_replace(genres, $1, $2) END`
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(retagSQL, retag), source.Slug, target.Slug, nullEditor(editorID))
+	if err != nil {
+		return err
+	}
+
+	aliases := target.Aliases
+	for _, name := range append([]string{source.Slug, source.Name}, source.Aliases...) {
+		if !validator.In(name, aliases...) && name != target.Name && name != target.Slug {
+			aliases = append(aliases, name)
+		}
+	}
+
+	query := `
+UPDATE genres
+SET aliases = $1, version = version + 1
+WHERE id = $2 AND version = $3
+RETURNING version`
+
+	err = tx.QueryRowContext(ctx, query, pq.Array(aliases), target.ID, target.Version).Scan(&target.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	target.Aliases = aliases
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM genres WHERE id = $1 AND version = $2`, source.ID, source.Version)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,93 @@
+package data
+
+import (
+	"github.com/asd/asd/internal/validator"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{input: "Sci-Fi", want: "sci-fi"},
+		{input: "sci fi", want: "sci-fi"},
+		{input: "SCI_FI", want: "sci-fi"},
+		{input: "  Science   Fiction! ", want: "science-fiction"},
+		{input: "--drama--", want: "drama"},
+		{input: "Film-Noir 2", want: "film-noir-2"},
+		{input: "!!!", want: ""},
+		{input: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := Slugify(tt.input); got != tt.want {
+			t.Errorf("Slugify(%q) = %q; want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestGenreLookupNormalize(t *testing.T) {
+	lookup := GenreLookup{
+		"sci-fi":          "sci-fi",
+		"science-fiction": "sci-fi",
+		"scifi":           "sci-fi",
+		"drama":           "drama",
+	}
+
+	tests := []struct {
+		input  string
+		want   string
+		wantOK bool
+	}{
+		{input: "sci-fi", want: "sci-fi", wantOK: true},
+		{input: "Science Fiction", want: "sci-fi", wantOK: true},
+		{input: "SCIFI", want: "sci-fi", wantOK: true},
+		{input: " Drama ", want: "drama", wantOK: true},
+		{input: "comedy", wantOK: false},
+		{input: "", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		got, ok := lookup.Normalize(tt.input)
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("Normalize(%q) = %q, %t; want %q, %t", tt.input, got, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	others := lookup.Except("sci-fi")
+	if _, ok := others.Normalize("science fiction"); ok {
+		t.Error("Except() kept the names of the excluded genre")
+	}
+	if _, ok := others.Normalize("drama"); !ok {
+		t.Error("Except() dropped the names of another genre")
+	}
+	if _, ok := lookup.Normalize("science fiction"); !ok {
+		t.Error("Except() modified the original lookup")
+	}
+}
+
+func TestValidateGenre(t *testing.T) {
+	others := GenreLookup{"drama": "drama", "melodrama": "drama"}
+
+	tests := []struct {
+		name  string
+		genre Genre
+		valid bool
+	}{
+		{name: "valid", genre: Genre{Slug: "sci-fi", Name: "Science Fiction", Aliases: []string{"scifi"}}, valid: true},
+		{name: "slug not slugified", genre: Genre{Slug: "Sci Fi", Name: "Science Fiction"}, valid: false},
+		{name: "missing name", genre: Genre{Slug: "sci-fi"}, valid: false},
+		{name: "duplicate aliases", genre: Genre{Slug: "sci-fi", Name: "Sci-Fi", Aliases: []string{"scifi", "scifi"}}, valid: false},
+		{name: "empty alias", genre: Genre{Slug: "sci-fi", Name: "Sci-Fi", Aliases: []string{"--"}}, valid: false},
+		{name: "alias used by another genre", genre: Genre{Slug: "tearjerker", Name: "Tearjerker", Aliases: []string{"Melodrama"}}, valid: false},
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+		ValidateGenre(v, &tt.genre, others)
+		if v.Valid() != tt.valid {
+			t.Errorf("%s: valid = %t; want %t (errors: %v)", tt.name, v.Valid(), tt.valid, v.Errors)
+		}
+	}
+}
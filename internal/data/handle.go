@@ -0,0 +1,160 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Handle is what the models run their queries against. NewModels() gives them the
+// connection pool, and a Batch gives them a single transaction which every query (and
+// every transaction the models start themselves) becomes part of.
+type Handle interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (Tx, error)
+}
+
+// Tx is a transaction started with Handle.BeginTx(). *sql.Tx satisfies it.
+type Tx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	Commit() error
+	Rollback() error
+}
+
+// pool is the Handle for the connection pool.
+type pool struct {
+	*sql.DB
+}
+
+func (p pool) BeginTx(ctx context.Context, opts *sql.TxOptions) (Tx, error) {
+	tx, err := p.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// A Batch is a transaction shared by a series of operations, for all-or-nothing batch
+// requests. Transactions the models start within it become savepoints, so a model
+// which rolls back its own work (after an edit conflict, for example) only undoes that
+// work, and its Commit() doesn't commit the batch. A Batch must not be used from more
+// than one goroutine at a time.
+type Batch struct {
+	tx         *sql.Tx
+	savepoints int
+}
+
+// BeginBatch() starts a batch transaction. It's rolled back if ctx is cancelled before
+// Commit() is called.
+func BeginBatch(ctx context.Context, db *sql.DB) (*Batch, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Batch{tx: tx}, nil
+}
+
+// Models() returns models which run every query in the batch transaction.
+func (b *Batch) Models() Models {
+	return newModels(b)
+}
+
+func (b *Batch) Commit() error {
+	return b.tx.Commit()
+}
+
+func (b *Batch) Rollback() error {
+	return b.tx.Rollback()
+}
+
+func (b *Batch) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return b.tx.ExecContext(ctx, query, args...)
+}
+
+func (b *Batch) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return b.tx.QueryContext(ctx, query, args...)
+}
+
+func (b *Batch) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return b.tx.QueryRowContext(ctx, query, args...)
+}
+
+// BeginTx() starts a savepoint in the batch transaction. The options are ignored, the
+// batch transaction's own apply.
+func (b *Batch) BeginTx(ctx context.Context, opts *sql.TxOptions) (Tx, error) {
+	b.savepoints++
+	sp := &savepoint{Tx: b.tx, name: fmt.Sprintf("batch_%d", b.savepoints)}
+
+	_, err := b.tx.ExecContext(ctx, "SAVEPOINT "+sp.name)
+	if err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// savepoint is a Tx nested in a Batch. Like *sql.Tx, once it has been committed or
+// rolled back any further Commit() or Rollback() returns sql.ErrTxDone, so the usual
+// deferred Rollback() is harmless.
+type savepoint struct {
+	*sql.Tx
+	name string
+	done bool
+}
+
+func (sp *savepoint) Commit() error {
+	if sp.done {
+		return sql.ErrTxDone
+	}
+	sp.done = true
+	_, err := sp.Tx.Exec("RELEASE SAVEPOINT " + sp.name)
+	return err
+}
+
+func (sp *savepoint) Rollback() error {
+	if sp.done {
+		return sql.ErrTxDone
+	}
+	sp.done = true
+	_, err := sp.Tx.Exec("ROLLBACK TO SAVEPOINT " + sp.name)
+	return err
+}
+
+// InTransaction() runs fn with a copy of the models whose queries all run in a single
+// transaction, which is committed if fn returns nil and rolled back otherwise. If the
+// models are already part of a Batch, the work becomes a savepoint in it instead.
+func (m Models) InTransaction(ctx context.Context, fn func(Models) error) error {
+	if batch, ok := m.db.(*Batch); ok {
+		sp, err := batch.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer sp.Rollback()
+
+		err = fn(m)
+		if err != nil {
+			return err
+		}
+		return sp.Commit()
+	}
+
+	p, ok := m.db.(pool)
+	if !ok {
+		return fmt.Errorf("models: unexpected database handle %T", m.db)
+	}
+	batch, err := BeginBatch(ctx, p.DB)
+	if err != nil {
+		return err
+	}
+	defer batch.Rollback()
+
+	err = fn(batch.Models())
+	if err != nil {
+		return err
+	}
+	return batch.Commit()
+}
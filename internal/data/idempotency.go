@@ -0,0 +1,125 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// An IdempotencyKey records a POST request made with an Idempotency-Key header, so that
+// a retry of the same request gets the original response instead of being run again.
+// Status is zero while the first request is still being handled. Keys are unique within
+// a Scope, which identifies the client: the user for authenticated requests, or the
+// client IP address for anonymous ones (whose UserID is zero).
+type IdempotencyKey struct {
+	Scope       string
+	UserID      int64
+	Key         string
+	RequestHash string
+	Status      int
+	Header      map[string][]string
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+type IdempotencyModel struct {
+	DB Handle
+}
+
+// Begin() claims a key for a new request, returning true if it was claimed. A key that
+// has expired (but not yet been swept) is claimed again. If the key is already in use,
+// Begin() returns false and fills in ik from the existing record, so the caller can
+// compare the request hash and replay the stored response.
+func (m IdempotencyModel) Begin(ik *IdempotencyKey, ttl time.Duration) (bool, error) {
+	query := `
+INSERT INTO idempotency_keys (scope, user_id, key, request_hash, expires_at)
+VALUES ($1, NULLIF($2, 0), $3, $4, $5)
+ON CONFLICT (scope, key) DO UPDATE
+SET request_hash = EXCLUDED.request_hash, status = 0, header = '{}', body = '', created_at = NOW(), expires_at = EXCLUDED.expires_at
+WHERE idempotency_keys.expires_at <= NOW()
+RETURNING created_at, expires_at`
+
+	args := []interface{}{ik.Scope, ik.UserID, ik.Key, ik.RequestHash, time.Now().Add(ttl)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&ik.CreatedAt, &ik.ExpiresAt)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+
+	query = `
+SELECT request_hash, status, header, body, created_at, expires_at
+FROM idempotency_keys
+WHERE scope = $1 AND key = $2`
+
+	var header []byte
+	err = m.DB.QueryRowContext(ctx, query, ik.Scope, ik.Key).Scan(
+		&ik.RequestHash,
+		&ik.Status,
+		&header,
+		&ik.Body,
+		&ik.CreatedAt,
+		&ik.ExpiresAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// Released by the first request in the meantime.
+			return false, ErrRecordNotFound
+		default:
+			return false, err
+		}
+	}
+	return false, json.Unmarshal(header, &ik.Header)
+}
+
+// Complete() stores the response to a request that claimed a key with Begin().
+func (m IdempotencyModel) Complete(ik *IdempotencyKey) error {
+	query := `
+UPDATE idempotency_keys
+SET status = $1, header = $2, body = $3
+WHERE scope = $4 AND key = $5`
+
+	header, err := json.Marshal(ik.Header)
+	if err != nil {
+		return err
+	}
+	args := []interface{}{ik.Status, header, ik.Body, ik.Scope, ik.Key}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Release() forgets a key, so that the request can be retried for real. It's used when
+// the response shouldn't be replayed, for example after a server error.
+func (m IdempotencyModel) Release(scope, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2`, scope, key)
+	return err
+}
+
+// DeleteExpired() removes the keys whose replay window has passed, and returns the
+// number of keys removed.
+func (m IdempotencyModel) DeleteExpired() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
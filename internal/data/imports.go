@@ -0,0 +1,178 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Import job statuses.
+const (
+	ImportPending   = "pending"
+	ImportRunning   = "running"
+	ImportCompleted = "completed"
+	ImportFailed    = "failed"
+)
+
+// ImportResult is the outcome of a single row in a bulk import. Line is the line number
+// in the uploaded file, so clients can match failures back to their source data.
+type ImportResult struct {
+	Line    int               `json:"line"`
+	Status  string            `json:"status"` // "created" or "failed"
+	MovieID int64             `json:"movie_id,omitempty"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+// ImportJob tracks an asynchronous import so that the client can poll for the report.
+type ImportJob struct {
+	ID         int64          `json:"id"`
+	UserID     int64          `json:"-"`
+	Format     string         `json:"format"`
+	Status     string         `json:"status"`
+	Total      int            `json:"total"`
+	Created    int            `json:"created"`
+	Failed     int            `json:"failed"`
+	Results    []ImportResult `json:"results"`
+	Error      string         `json:"error,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	// The uploaded file and options, kept until the import has run.
+	Source         []byte `json:"-"`
+	AllowDuplicate bool   `json:"-"`
+}
+
+type ImportJobModel struct {
+	DB Handle
+}
+
+func (m ImportJobModel) Insert(job *ImportJob) error {
+	query := `
+INSERT INTO import_jobs (user_id, format, status, total, source, allow_duplicate)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id, created_at`
+
+	args := []interface{}{job.UserID, job.Format, job.Status, job.Total, job.Source, job.AllowDuplicate}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&job.ID, &job.CreatedAt)
+}
+
+// Start() moves a pending job to running and returns it, with its uploaded file. A job
+// which isn't pending any more (it was started before, by an attempt that never
+// finished) is ErrEditConflict.
+func (m ImportJobModel) Start(id int64) (*ImportJob, error) {
+	query := `
+UPDATE import_jobs
+SET status = $1
+WHERE id = $2 AND status = $3
+RETURNING id, user_id, format, status, total, source, allow_duplicate, created_at`
+
+	var job ImportJob
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, ImportRunning, id, ImportPending).Scan(
+		&job.ID,
+		&job.UserID,
+		&job.Format,
+		&job.Status,
+		&job.Total,
+		&job.Source,
+		&job.AllowDuplicate,
+		&job.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrEditConflict
+		default:
+			return nil, err
+		}
+	}
+	return &job, nil
+}
+
+// Interrupt() fails a job which was left running by an attempt that never finished.
+// Some of its rows may have been created, so it isn't run again.
+func (m ImportJobModel) Interrupt(id int64) error {
+	query := `
+UPDATE import_jobs
+SET status = $1, error = 'import was interrupted before it finished', source = NULL, finished_at = NOW()
+WHERE id = $2 AND status = $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, ImportFailed, id, ImportRunning)
+	return err
+}
+
+// Update() saves the outcome and results of a job which has finished, and drops its
+// uploaded file.
+func (m ImportJobModel) Update(job *ImportJob) error {
+	query := `
+UPDATE import_jobs
+SET status = $1, created = $2, failed = $3, results = $4, error = $5, finished_at = $6, source = NULL
+WHERE id = $7`
+
+	results, err := json.Marshal(job.Results)
+	if err != nil {
+		return err
+	}
+	args := []interface{}{job.Status, job.Created, job.Failed, results, job.Error, job.FinishedAt, job.ID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Get() returns an import job, but only if it belongs to the given user.
+func (m ImportJobModel) Get(id, userID int64) (*ImportJob, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT id, user_id, format, status, total, created, failed, results, error, created_at, finished_at
+FROM import_jobs
+WHERE id = $1 AND user_id = $2`
+
+	var job ImportJob
+	var results []byte
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&job.ID,
+		&job.UserID,
+		&job.Format,
+		&job.Status,
+		&job.Total,
+		&job.Created,
+		&job.Failed,
+		&results,
+		&job.Error,
+		&job.CreatedAt,
+		&job.FinishedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	err = json.Unmarshal(results, &job.Results)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
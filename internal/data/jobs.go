@@ -0,0 +1,309 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Job statuses. A job that has failed MaxAttempts times is "dead": it's kept, with its
+// last error, until an admin retries it.
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobDead      = "dead"
+)
+
+const (
+	// Jobs are given this many attempts unless Enqueue() is told otherwise.
+	jobDefaultMaxAttempts = 10
+	// The delay before the first retry, doubled after every further failure.
+	jobRetryBase = 10 * time.Second
+	jobRetryMax  = time.Hour
+	// A job whose lease hasn't been renewed for this long is assumed to have been lost
+	// (the worker crashed, say) and is picked up again.
+	jobLease = 10 * time.Minute
+)
+
+// Workers renew the lease on a running job this often, so that a job which takes longer
+// than the lease isn't claimed a second time while it's still running.
+const JobHeartbeatInterval = jobLease / 5
+
+// Job kinds, each with the type of its payload.
+const (
+	JobWelcomeEmail = "user.welcome_email"
+	JobMovieImport  = "movies.import"
+)
+
+// WelcomeEmailJob sends a new user their welcome email with an activation token.
+type WelcomeEmailJob struct {
+	UserID int64  `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+// MovieImportJob runs an asynchronous import, from the file stored with it.
+type MovieImportJob struct {
+	ImportID int64 `json:"import_id"`
+}
+
+// A Job is a unit of work in the jobs table, run by one of the workers.
+type Job struct {
+	ID          int64           `json:"id"`
+	CreatedAt   time.Time       `json:"created_at"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	FinishedAt  *time.Time      `json:"finished_at,omitempty"`
+}
+
+// JobRetryDelay() returns how long to wait before running a job again after the given
+// number of failed attempts: 10s, 20s, 40s and so on, up to an hour.
+func JobRetryDelay(attempts int) time.Duration {
+	delay := jobRetryBase
+	for i := 1; i < attempts && delay < jobRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > jobRetryMax {
+		delay = jobRetryMax
+	}
+	return delay
+}
+
+type JobModel struct {
+	DB Handle
+}
+
+// Enqueue() adds a job of the given kind, with its payload encoded as JSON. It's run as
+// soon as a worker is free. When the models share a transaction, the job is only
+// visible to the workers once it commits.
+func (m JobModel) Enqueue(kind string, payload interface{}) error {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	query := `
+INSERT INTO jobs (kind, payload, max_attempts)
+VALUES ($1, $2, $3)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, kind, js, jobDefaultMaxAttempts)
+	return err
+}
+
+// Claim() takes the next job that's due and marks it running, or returns nil if there
+// isn't one. SKIP LOCKED lets any number of workers claim jobs at the same time without
+// waiting on each other or getting the same job. A job whose lease has run out is
+// claimed again if it has attempts left, and marked dead if it hasn't.
+func (m JobModel) Claim() (*Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+UPDATE jobs
+SET status = 'dead', last_error = 'lease expired while running', finished_at = NOW(), locked_at = NULL
+WHERE status = 'running' AND locked_at < NOW() - $1 * interval '1 second' AND attempts >= max_attempts`, jobLease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+UPDATE jobs
+SET status = 'running', attempts = attempts + 1, locked_at = NOW()
+WHERE id = (
+    SELECT id
+    FROM jobs
+    WHERE (status = 'pending' AND run_at <= NOW())
+    OR (status = 'running' AND locked_at < NOW() - $1 * interval '1 second' AND attempts < max_attempts)
+    ORDER BY run_at ASC, id ASC
+    LIMIT 1
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING id, created_at, kind, payload, status, attempts, max_attempts, run_at`
+
+	var job Job
+
+	err = m.DB.QueryRowContext(ctx, query, jobLease.Seconds()).Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.Kind,
+		&job.Payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+	return &job, nil
+}
+
+// Heartbeat() renews the lease on a claimed job. The attempt number identifies the
+// claim, so ErrEditConflict is returned if the job has been claimed again since.
+func (m JobModel) Heartbeat(job *Job) error {
+	query := `
+UPDATE jobs
+SET locked_at = NOW()
+WHERE id = $1 AND status = 'running' AND attempts = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, job.ID, job.Attempts)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// Finish() records the outcome of running a claimed job. A failed job is retried after
+// JobRetryDelay(), or marked dead if it has used all of its attempts. As with
+// Heartbeat(), ErrEditConflict is returned if the job has been claimed again since,
+// and the outcome isn't recorded.
+func (m JobModel) Finish(job *Job, jobErr error) error {
+	now := time.Now()
+
+	switch {
+	case jobErr == nil:
+		job.Status = JobSucceeded
+		job.LastError = ""
+		job.FinishedAt = &now
+	case job.Attempts >= job.MaxAttempts:
+		job.Status = JobDead
+		job.LastError = jobErr.Error()
+		job.FinishedAt = &now
+	default:
+		job.Status = JobPending
+		job.LastError = jobErr.Error()
+		job.RunAt = now.Add(JobRetryDelay(job.Attempts))
+	}
+
+	query := `
+UPDATE jobs
+SET status = $1, last_error = $2, run_at = $3, finished_at = $4, locked_at = NULL
+WHERE id = $5 AND status = 'running' AND attempts = $6`
+
+	args := []interface{}{job.Status, job.LastError, job.RunAt, job.FinishedAt, job.ID, job.Attempts}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// GetAll() returns a page of the jobs with the given status, newest first.
+func (m JobModel) GetAll(status string, filters Filters) ([]*Job, Metadata, error) {
+	query := `
+SELECT count(*) OVER(), id, created_at, kind, payload, status, attempts, max_attempts, run_at, last_error, finished_at
+FROM jobs
+WHERE status = $1
+ORDER BY id DESC
+LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, status, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	jobs := []*Job{}
+
+	for rows.Next() {
+		var job Job
+		err := rows.Scan(
+			&totalRecords,
+			&job.ID,
+			&job.CreatedAt,
+			&job.Kind,
+			&job.Payload,
+			&job.Status,
+			&job.Attempts,
+			&job.MaxAttempts,
+			&job.RunAt,
+			&job.LastError,
+			&job.FinishedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		jobs = append(jobs, &job)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return jobs, metadata, nil
+}
+
+// Retry() puts a dead job back in the queue with a fresh set of attempts, and returns
+// it. ErrRecordNotFound is returned if there's no dead job with the given ID.
+func (m JobModel) Retry(id int64) (*Job, error) {
+	query := `
+UPDATE jobs
+SET status = 'pending', attempts = 0, run_at = NOW(), finished_at = NULL
+WHERE id = $1 AND status = 'dead'
+RETURNING id, created_at, kind, payload, status, attempts, max_attempts, run_at, last_error`
+
+	var job Job
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.Kind,
+		&job.Payload,
+		&job.Status,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&job.RunAt,
+		&job.LastError,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &job, nil
+}
@@ -0,0 +1,34 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 0, want: 10 * time.Second},
+		{attempts: 1, want: 10 * time.Second},
+		{attempts: 2, want: 20 * time.Second},
+		{attempts: 3, want: 40 * time.Second},
+		{attempts: 9, want: 2560 * time.Second},
+		{attempts: 10, want: time.Hour},
+		{attempts: 1000, want: time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := JobRetryDelay(tt.attempts); got != tt.want {
+			t.Errorf("JobRetryDelay(%d) = %s; want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestJobHeartbeatInterval(t *testing.T) {
+	// A live worker must renew its lease several times before it can run out.
+	if JobHeartbeatInterval <= 0 || 2*JobHeartbeatInterval >= jobLease {
+		t.Errorf("JobHeartbeatInterval = %s; want well under the %s lease", JobHeartbeatInterval, jobLease)
+	}
+}
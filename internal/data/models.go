@@ -15,19 +15,54 @@ var (
 // Create a Models struct which wraps the MovieModel. We'll add other models to this,
 // like a UserModel and PermissionModel, as our build progresses.
 type Models struct {
-	Movies   MovieModel
-	Trailers TrailerModel
-	Users    UserModel
-	Tokens   TokenModel
+	Movies       MovieModel
+	Trailers     TrailerModel
+	Actors       ActorModel
+	Users        UserModel
+	Tokens       TokenModel
+	Permissions  PermissionModel
+	Revisions    RevisionModel
+	ImportJobs   ImportJobModel
+	Reviews      ReviewModel
+	Watchlists   WatchlistModel
+	Genres       GenreModel
+	Translations TranslationModel
+	Similarities SimilarityModel
+	Idempotency  IdempotencyModel
+	Webhooks     WebhookModel
+	Events       EventModel
+	Jobs         JobModel
+
+	// The handle the models share, for InTransaction().
+	db Handle
 }
 
 // For ease of use, we also add a New() method which returns a Models struct containing
 // the initialized MovieModel.
 func NewModels(db *sql.DB) Models {
+	return newModels(pool{db})
+}
+
+// newModels() returns models which all use the given database handle.
+func newModels(db Handle) Models {
 	return Models{
-		Movies:   MovieModel{DB: db},
-		Trailers: TrailerModel{DB: db},
-		Users:    UserModel{DB: db},
-		Tokens:   TokenModel{DB: db},
+		Movies:       MovieModel{DB: db},
+		Trailers:     TrailerModel{DB: db},
+		Actors:       ActorModel{DB: db},
+		Users:        UserModel{DB: db},
+		Tokens:       TokenModel{DB: db},
+		Permissions:  PermissionModel{DB: db},
+		Revisions:    RevisionModel{DB: db},
+		ImportJobs:   ImportJobModel{DB: db},
+		Reviews:      ReviewModel{DB: db},
+		Watchlists:   WatchlistModel{DB: db},
+		Genres:       GenreModel{DB: db},
+		Translations: TranslationModel{DB: db},
+		Similarities: SimilarityModel{DB: db},
+		Idempotency:  IdempotencyModel{DB: db},
+		Webhooks:     WebhookModel{DB: db},
+		Events:       EventModel{DB: db},
+		Jobs:         JobModel{DB: db},
+		db:           db,
 	}
 }
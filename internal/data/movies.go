@@ -3,6 +3,7 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/asd/asd/internal/validator"
@@ -13,23 +14,40 @@ import (
 // By default, the keys in the JSON object are equal to the field names in the struct ( ID,
 // CreatedAt, Title and so on).
 type Movie struct {
-	ID        int64     `json:"id"`                       // Unique integer ID for the movie
-	CreatedAt time.Time `json:"-"`                        // Timestamp for when the movie is added to our database, "-" directive, hidden in response
-	Title     string    `json:"title"`                    // Movie title
-	Year      int32     `json:"year,omitempty"`           // Movie release year, "omitempty" - hide from response if empty
-	Runtime   int32     `json:"runtime,omitempty,string"` // Movie runtime (in minutes), "string" - convert int to string
-	//		  Runtime										I'm just curious
-	Genres  []string `json:"genres,omitempty"` // Slice of genres for the movie (romance, comedy, etc.)
-	Version int32    `json:"version"`          // The version number starts at 1 and will be incremented each
+	ID        int64     `json:"id"`                // Unique integer ID for the movie
+	CreatedAt time.Time `json:"-"`                 // Timestamp for when the movie is added to our database, "-" directive, hidden in response
+	Title     string    `json:"title"`             // Movie title
+	Year      int32     `json:"year,omitempty"`    // Movie release year, "omitempty" - hide from response if empty
+	Runtime   Runtime   `json:"runtime,omitempty"` // Movie runtime (in minutes), written as "<runtime> mins"
+	Genres    []string  `json:"genres,omitempty"`  // Slice of genres for the movie (romance, comedy, etc.)
+	Version   int32     `json:"version"`           // The version number starts at 1 and will be incremented each
 	// time the movie information is updated
+	DeletedAt *time.Time `json:"deleted_at,omitempty"` // Set when the movie has been moved to the trash, nil otherwise
+	// Aggregated from the reviews table, read-only.
+	AverageRating float64 `json:"average_rating"`
+	RatingCount   int32   `json:"rating_count"`
+	// Set when the title has been replaced by a translation (see
+	// TranslationModel.Localize()).
+	OriginalTitle string `json:"original_title,omitempty"`
+	Synopsis      string `json:"synopsis,omitempty"`
+	Locale        string `json:"locale,omitempty"`
+	// Uploaded images, encoded as the URL of the full size image.
+	Poster   Artwork `json:"poster_url,omitempty"`
+	Backdrop Artwork `json:"backdrop_url,omitempty"`
+	// How well the movie matched the title search, only set by GetAll().
+	Relevance float64 `json:"relevance,omitempty"`
 }
 
 // Define a MovieModel struct type which wraps a sql.DB connection pool.
 type MovieModel struct {
-	DB *sql.DB
+	DB Handle
 }
 
-func ValidateMovie(v *validator.Validator, movie *Movie) {
+// ValidateMovie() checks a movie before it's saved. Its genres are also normalized:
+// each is replaced by the slug of the matching genre in the taxonomy (so "Sci Fi" and
+// "science fiction" both become "sci-fi"), and genres that aren't in the taxonomy are
+// rejected.
+func ValidateMovie(v *validator.Validator, movie *Movie, genres GenreLookup) {
 	v.Check(movie.Title != "", "title", "must be provided")
 	v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
 
@@ -43,6 +61,14 @@ func ValidateMovie(v *validator.Validator, movie *Movie) {
 	v.Check(movie.Genres != nil, "genres", "must be provided")
 	v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
 	v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
+	for i, genre := range movie.Genres {
+		slug, ok := genres.Normalize(genre)
+		if !ok {
+			v.AddError("genres", fmt.Sprintf("unknown genre %q", genre))
+			continue
+		}
+		movie.Genres[i] = slug
+	}
 	v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
 }
 
@@ -69,6 +95,108 @@ RETURNING id, created_at, version`
 	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
 }
 
+// InsertBatch() inserts a batch of movies in a single transaction with COPY, along with
+// their first revision. Either every movie in the batch is created or none of them are.
+// The system-generated fields are written back into each movie struct.
+//
+// Unless allowDuplicates is set, movies which look like an existing movie, or like an
+// earlier movie in the same batch, are skipped and returned keyed by their index in
+// movies. The check holds the advisory locks of duplicateLock(), so the same film can't
+// be inserted concurrently between the check and the COPY.
+func (m MovieModel) InsertBatch(movies []*Movie, editorID int64, allowDuplicates bool) (map[int]*BatchDuplicate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	duplicates := map[int]*BatchDuplicate{}
+	if !allowDuplicates {
+		duplicates, err = findBatchDuplicates(ctx, tx, movies)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var insert []*Movie
+	for i, movie := range movies {
+		if duplicates[i] == nil {
+			insert = append(insert, movie)
+		}
+	}
+	if len(insert) == 0 {
+		return duplicates, tx.Commit()
+	}
+
+	// COPY can't return the generated columns, so the IDs are taken from the sequence
+	// up front and written explicitly.
+	rows, err := tx.QueryContext(ctx, `
+SELECT nextval(pg_get_serial_sequence('movies', 'id')), now()::timestamp(0) with time zone
+FROM generate_series(1, $1)`, len(insert))
+	if err != nil {
+		return nil, err
+	}
+	for _, movie := range insert {
+		if !rows.Next() {
+			rows.Close()
+			return nil, errors.New("movies: sequence returned too few IDs")
+		}
+		err = rows.Scan(&movie.ID, &movie.CreatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		movie.Version = 1
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	err = copyIn(ctx, tx, pq.CopyIn("movies", "id", "created_at", "title", "year", "runtime", "genres"), insert, func(movie *Movie) []interface{} {
+		return []interface{}{movie.ID, movie.CreatedAt, movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var editor *int64
+	if editorID > 0 {
+		editor = &editorID
+	}
+	err = copyIn(ctx, tx, pq.CopyIn("movie_revisions", "movie_id", "version", "title", "year", "runtime", "genres", "editor_id"), insert, func(movie *Movie) []interface{} {
+		return []interface{}{movie.ID, movie.Version, movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), editor}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return duplicates, tx.Commit()
+}
+
+// copyIn() runs a COPY statement made by pq.CopyIn() with one row per movie.
+func copyIn(ctx context.Context, tx Tx, query string, movies []*Movie, row func(*Movie) []interface{}) error {
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, movie := range movies {
+		_, err = stmt.ExecContext(ctx, row(movie)...)
+		if err != nil {
+			return err
+		}
+	}
+	// Executing the statement without arguments flushes the buffered rows.
+	_, err = stmt.ExecContext(ctx)
+	return err
+}
+
 func (m MovieModel) Get(id int64) (*Movie, error) {
 	// The PostgreSQL bigserial type that we're using for the movie ID starts
 	// auto-incrementing at 1 by default, so we know that no movies will have ID values
@@ -78,10 +206,11 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		return nil, ErrRecordNotFound
 	}
 	// Define the SQL query for retrieving the movie data.
-	query := `
-SELECT id, created_at, title, year, runtime, genres, version
+	query := fmt.Sprintf(`
+SELECT id, created_at, title, year, runtime, genres, version, average_rating, rating_count, poster, backdrop
 FROM movies
-WHERE id = $1`
+CROSS JOIN LATERAL (%s) AS ratings
+WHERE id = $1 AND deleted_at IS NULL`, movieRatingsSQL)
 	// Declare a Movie struct to hold the data returned by the query.
 	var movie Movie
 
@@ -102,6 +231,10 @@ WHERE id = $1`
 		&movie.Runtime,
 		pq.Array(&movie.Genres),
 		&movie.Version,
+		&movie.AverageRating,
+		&movie.RatingCount,
+		&movie.Poster,
+		&movie.Backdrop,
 	)
 	// Handle any errors. If there was no matching movie found, Scan() will return
 	// a sql.ErrNoRows error. We check for this and return our custom ErrRecordNotFound
@@ -125,7 +258,7 @@ func (m MovieModel) Update(movie *Movie) error {
 	query := `
 UPDATE movies
 SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-WHERE id = $5 AND version = $6
+WHERE id = $5 AND version = $6 AND deleted_at IS NULL
 RETURNING version`
 	// Create an args slice containing the values for the placeholder parameters.
 	args := []interface{}{
@@ -155,23 +288,35 @@ RETURNING version`
 	return nil
 }
 
+// Delete() doesn't remove the record any more, it moves it to the trash by setting
+// deleted_at. Trashed movies are hidden from Get() and GetAll() until they are either
+// restored with Restore() or permanently removed by Purge().
 func (m MovieModel) Delete(id int64) error {
 	// Return an ErrRecordNotFound error if the movie ID is less than 1.
 	if id < 1 {
 		return ErrRecordNotFound
 	}
-	// Construct the SQL query to delete the record.
+	// Construct the SQL query to soft-delete the record.
 	query := `
-DELETE FROM movies
-WHERE id = $1`
+UPDATE movies
+SET deleted_at = NOW()
+WHERE id = $1 AND deleted_at IS NULL`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	// The movie is trashed and taken off every watchlist in one transaction. Restoring
+	// the movie doesn't bring the watchlist entries back.
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	// Execute the SQL query using the Exec() method, passing in the id variable as
 	// the value for the placeholder parameter. The Exec() method returns a sql.Result
 	// object.
-	result, err := m.DB.ExecContext(ctx, query, id)
+	result, err := tx.ExecContext(ctx, query, id)
 	if err != nil {
 		return err
 	}
@@ -187,17 +332,260 @@ WHERE id = $1`
 	if rowsAffected == 0 {
 		return ErrRecordNotFound
 	}
-	return nil
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM watchlist_entries WHERE movie_id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
-	query := fmt.Sprintf(`
-SELECT count(*) OVER, id, created_at, title, year, runtime, genres, version
+// Restore() takes a movie out of the trash and returns the restored record. If there
+// is no trashed movie with the given ID we return ErrRecordNotFound.
+func (m MovieModel) Restore(id int64) (*Movie, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+UPDATE movies
+SET deleted_at = NULL
+WHERE id = $1 AND deleted_at IS NOT NULL
+RETURNING id, created_at, title, year, runtime, genres, version`
+
+	var movie Movie
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&movie.ID,
+		&movie.CreatedAt,
+		&movie.Title,
+		&movie.Year,
+		&movie.Runtime,
+		pq.Array(&movie.Genres),
+		&movie.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &movie, nil
+}
+
+// Purge() permanently removes the movies which have been in the trash for longer than
+// the given retention period, and returns the number of records removed.
+func (m MovieModel) Purge(retention time.Duration) (int64, error) {
+	query := `
+DELETE FROM movies
+WHERE deleted_at IS NOT NULL AND deleted_at < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now().Add(-retention))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetAllDeleted() returns a page of the movies which are currently in the trash, most
+// recently deleted first.
+func (m MovieModel) GetAllDeleted(filters Filters) ([]*Movie, Metadata, error) {
+	query := `
+SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version, deleted_at
 FROM movies
-WHERE (to_tsvector('english', title) @@ plainto_tsquery('english', $1) OR $1 = '')
-AND (genres @> $2 OR $2 = '{}') 
-ORDER BY %s %s, id ASC
-LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+WHERE deleted_at IS NOT NULL
+ORDER BY deleted_at DESC, id ASC
+LIMIT $1 OFFSET $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	movies := []*Movie{}
+
+	for rows.Next() {
+		var movie Movie
+		err := rows.Scan(
+			&totalRecords,
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.DeletedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		movies = append(movies, &movie)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return movies, metadata, nil
+}
+
+// movieRatingsSQL aggregates the reviews of the current movies row. It's used as a
+// lateral subquery, which makes average_rating and rating_count available as ordinary
+// columns (including for ORDER BY).
+const movieRatingsSQL = `
+SELECT COALESCE(ROUND(AVG(reviews.rating), 2), 0)::float8 AS average_rating, COUNT(reviews.id)::integer AS rating_count
+FROM reviews
+WHERE reviews.movie_id = movies.id`
+
+// MovieQuery holds the client-supplied conditions for listing (and exporting) movies.
+// Zero values mean "no condition", so an empty MovieQuery matches every movie.
+type MovieQuery struct {
+	Title         string
+	Genres        []string
+	GenresMode    string // "all" (the default) or "any"
+	ExcludeGenres []string
+	YearMin       int
+	YearMax       int
+	RuntimeMin    int
+	RuntimeMax    int
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+func ValidateMovieQuery(v *validator.Validator, q MovieQuery) {
+	v.Check(validator.In(q.GenresMode, "all", "any"), "genres_mode", "must be one of all or any")
+
+	v.Check(q.YearMin >= 0, "year_min", "must not be negative")
+	v.Check(q.YearMax >= 0, "year_max", "must not be negative")
+	v.Check(q.YearMax == 0 || q.YearMin <= q.YearMax, "year_min", "must not be greater than year_max")
+
+	v.Check(q.RuntimeMin >= 0, "runtime_min", "must not be negative")
+	v.Check(q.RuntimeMax >= 0, "runtime_max", "must not be negative")
+	v.Check(q.RuntimeMax == 0 || q.RuntimeMin <= q.RuntimeMax, "runtime_min", "must not be greater than runtime_max")
+
+	v.Check(q.CreatedAfter.IsZero() || q.CreatedBefore.IsZero() || q.CreatedAfter.Before(q.CreatedBefore),
+		"created_after", "must be earlier than created_before")
+}
+
+// args() returns the placeholder values for movieFilterSQL, in order.
+func (q MovieQuery) args() []interface{} {
+	// The nil times are sent as NULL, which the "OR $n IS NULL" checks pick up.
+	var after, before *time.Time
+	if !q.CreatedAfter.IsZero() {
+		after = &q.CreatedAfter
+	}
+	if !q.CreatedBefore.IsZero() {
+		before = &q.CreatedBefore
+	}
+	return []interface{}{
+		q.Title,
+		pq.Array(q.Genres),
+		q.GenresMode,
+		pq.Array(q.ExcludeGenres),
+		q.YearMin,
+		q.YearMax,
+		q.RuntimeMin,
+		q.RuntimeMax,
+		after,
+		before,
+	}
+}
+
+// movieFilterSQL is the WHERE clause shared by GetAll() and Export(). Every condition
+// is a fixed piece of SQL which switches itself off when its placeholder holds the
+// zero value, so the client input only ever reaches the database as a parameter. The
+// placeholders $1 to $10 are filled by MovieQuery.args().
+//
+// The title matches either on the full-text search or, to catch partial words and
+// misspellings, on pg_trgm's word_similarity() with the same 0.3 cut-off as
+// similarityThreshold. The same goes for the translated titles, each of which is
+// searched with the text search configuration of its own language.
+const movieFilterSQL = `(to_tsvector('english', title) @@ plainto_tsquery('english', $1) OR word_similarity($1, title) >= 0.3 OR $1 = ''
+    OR EXISTS (
+        SELECT 1 FROM movie_translations
+        WHERE movie_translations.movie_id = movies.id
+        AND (to_tsvector(search_config, movie_translations.title) @@ plainto_tsquery(search_config, $1) OR word_similarity($1, movie_translations.title) >= 0.3)
+    ))
+AND (CASE WHEN $3 = 'any' THEN genres && $2 ELSE genres @> $2 END OR $2 = '{}')
+AND NOT (genres && $4)
+AND (year >= $5 OR $5 = 0)
+AND (year <= $6 OR $6 = 0)
+AND (runtime >= $7 OR $7 = 0)
+AND (runtime <= $8 OR $8 = 0)
+AND (created_at >= $9 OR $9 IS NULL)
+AND (created_at < $10 OR $10 IS NULL)
+AND deleted_at IS NULL`
+
+// movieRelevanceSQL scores a movie against the title search in $1, as the better of
+// the full-text rank and the trigram word similarity. Both are between 0 and 1.
+const movieRelevanceSQL = `CASE WHEN $1 = '' THEN 0
+    ELSE GREATEST(ts_rank(to_tsvector('english', title), plainto_tsquery('english', $1)), word_similarity($1, title))
+END::float8 AS relevance`
+
+func (m MovieModel) GetAll(q MovieQuery, filters Filters) ([]*Movie, Metadata, error) {
+	movies, metadata, _, err := m.GetAllWithFacets(q, filters, nil)
+	return movies, metadata, err
+}
+
+// Facets holds the number of movies per genre, per release year and per decade in a
+// filtered result set. Only the facets that were asked for are filled in.
+type Facets struct {
+	Genres map[string]int `json:"genres,omitempty"`
+	Year   map[string]int `json:"year,omitempty"`
+	Decade map[string]int `json:"decade,omitempty"`
+}
+
+// FacetSafelist lists the facet names accepted by GetAllWithFacets().
+var FacetSafelist = []string{"genres", "year", "decade"}
+
+// GetAllWithFacets() works like GetAll() but also counts the whole filtered set (not
+// just the current page) by the requested facets. Everything is computed in a single
+// query: the filtered rows are collected once in a CTE, and the facet counts are
+// uncorrelated subqueries over it, so Postgres evaluates them once and repeats the
+// result on every row. Facets that weren't requested are switched off by their
+// boolean placeholder and never evaluated.
+func (m MovieModel) GetAllWithFacets(q MovieQuery, filters Filters, facets []string) ([]*Movie, Metadata, Facets, error) {
+	orderBy, err := filters.orderBy()
+	if err != nil {
+		return nil, Metadata{}, Facets{}, err
+	}
+	query := fmt.Sprintf(`
+WITH filtered AS (
+    SELECT id, created_at, title, year, runtime, genres, version, average_rating, rating_count, poster, backdrop, %s
+    FROM movies
+    CROSS JOIN LATERAL (%s) AS ratings
+    WHERE %s
+)
+SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version, average_rating, rating_count, poster, backdrop, relevance,
+    json_build_object(
+        'genres', CASE WHEN $13 THEN (
+            SELECT json_object_agg(genre, total)
+            FROM (SELECT unnest(genres) AS genre, count(*) AS total FROM filtered GROUP BY genre) AS genre_counts
+        ) END,
+        'year', CASE WHEN $14 THEN (
+            SELECT json_object_agg(year, total)
+            FROM (SELECT year, count(*) AS total FROM filtered GROUP BY year) AS year_counts
+        ) END,
+        'decade', CASE WHEN $15 THEN (
+            SELECT json_object_agg(decade, total)
+            FROM (SELECT year / 10 * 10 AS decade, count(*) AS total FROM filtered GROUP BY decade) AS decade_counts
+        ) END
+    )
+FROM filtered
+ORDER BY %s
+LIMIT $11 OFFSET $12`, movieRelevanceSQL, movieRatingsSQL, movieFilterSQL, orderBy)
 	// @> symbol is the ‘contains’ operator for PostgreSQL arrays
 	// && ‘overlap’ operator
 	// The @@ operator is the matches operator. In our statement we are using it to check whether
@@ -209,12 +597,15 @@ LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 	// values for the placeholders in a slice. Notice here how we call the limit() and
 	// offset() methods on the Filters struct to get the appropriate values for the
 	// LIMIT and OFFSET clauses.
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := append(q.args(), filters.limit(), filters.offset())
+	for _, facet := range FacetSafelist {
+		args = append(args, validator.In(facet, facets...))
+	}
 
 	// And then pass the args slice to QueryContext() as a variadic parameter.
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, Facets{}, err
 	}
 	// Importantly, defer a call to rows.Close() to ensure that the resultset is closed
 	// before GetAll() returns.
@@ -222,6 +613,7 @@ LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 
 	totalRecords := 0
 	movies := []*Movie{}
+	var facetsJSON []byte
 
 	// Use rows.Next to iterate through the rows in the resultset.
 	for rows.Next() {
@@ -238,9 +630,15 @@ LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&movie.AverageRating,
+			&movie.RatingCount,
+			&movie.Poster,
+			&movie.Backdrop,
+			&movie.Relevance,
+			&facetsJSON,
 		)
 		if err != nil {
-			return nil, Metadata{}, err
+			return nil, Metadata{}, Facets{}, err
 		}
 		// Add the Movie struct to the slice.
 		movies = append(movies, &movie)
@@ -248,9 +646,93 @@ LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
 	// When the rows.Next() loop has finished, call rows.Err() to retrieve any error
 	// that was encountered during the iteration.
 	if err = rows.Err(); err != nil {
-		return nil, Metadata{}, err
+		return nil, Metadata{}, Facets{}, err
 	}
 	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	// The facet counts are the same on every row. If there were no rows (either nothing
+	// matched, or the page is past the end) the facets are left empty, the same as the
+	// metadata.
+	var result Facets
+	if facetsJSON != nil {
+		err = json.Unmarshal(facetsJSON, &result)
+		if err != nil {
+			return nil, Metadata{}, Facets{}, err
+		}
+	}
 	// If everything went OK, then return the slice of movies.
-	return movies, metadata, nil
+	return movies, metadata, result, nil
+}
+
+// Export() walks every movie matching the query, in ID order, using a server-side
+// cursor so that the full result set is never held in memory. The movies are passed to
+// fn in batches; if fn returns an error the export stops and that error is returned.
+// Unlike the other methods this takes a context from the caller, because an export
+// runs for as long as the client keeps reading rather than a fixed timeout.
+func (m MovieModel) Export(ctx context.Context, q MovieQuery, fn func([]*Movie) error) error {
+	// Cursors only live inside a transaction.
+	tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf(`
+DECLARE movie_export NO SCROLL CURSOR FOR
+SELECT id, created_at, title, year, runtime, genres, version, average_rating, rating_count
+FROM movies
+CROSS JOIN LATERAL (%s) AS ratings
+WHERE %s
+ORDER BY id ASC`, movieRatingsSQL, movieFilterSQL)
+
+	_, err = tx.ExecContext(ctx, query, q.args()...)
+	if err != nil {
+		return err
+	}
+
+	for {
+		rows, err := tx.QueryContext(ctx, `FETCH 500 FROM movie_export`)
+		if err != nil {
+			return err
+		}
+
+		movies := []*Movie{}
+		for rows.Next() {
+			var movie Movie
+			err := rows.Scan(
+				&movie.ID,
+				&movie.CreatedAt,
+				&movie.Title,
+				&movie.Year,
+				&movie.Runtime,
+				pq.Array(&movie.Genres),
+				&movie.Version,
+				&movie.AverageRating,
+				&movie.RatingCount,
+			)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			movies = append(movies, &movie)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		// An empty fetch means the cursor is exhausted.
+		if len(movies) == 0 {
+			return nil
+		}
+		if err = fn(movies); err != nil {
+			return err
+		}
+	}
+}
+
+// Suggest() returns up to limit movie titles for autocompletion, titles starting with q
+// first and then the closest fuzzy matches. Movies in the trash are left out.
+func (m MovieModel) Suggest(q string, limit int) ([]*Suggestion, error) {
+	return suggest(m.DB, "movies", "title", "deleted_at IS NULL", q, limit)
 }
@@ -0,0 +1,185 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"time"
+)
+
+// A MovieRevision is a snapshot of a movie record as it was at a specific version,
+// along with the user who made the change (nil for anonymous edits and for the
+// history seeded by the migration).
+type MovieRevision struct {
+	MovieID   int64     `json:"movie_id"`
+	Version   int32     `json:"version"`
+	Title     string    `json:"title"`
+	Year      int32     `json:"year"`
+	Runtime   Runtime   `json:"runtime"`
+	Genres    []string  `json:"genres"`
+	EditorID  *int64    `json:"editor_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// FieldChange holds the before and after values of a single field in a revision diff.
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// DiffRevisions() compares two revisions of the same movie and returns the fields which
+// differ between them, keyed by their JSON name.
+func DiffRevisions(from, to *MovieRevision) map[string]FieldChange {
+	changes := make(map[string]FieldChange)
+	if from.Title != to.Title {
+		changes["title"] = FieldChange{From: from.Title, To: to.Title}
+	}
+	if from.Year != to.Year {
+		changes["year"] = FieldChange{From: from.Year, To: to.Year}
+	}
+	if from.Runtime != to.Runtime {
+		changes["runtime"] = FieldChange{From: from.Runtime, To: to.Runtime}
+	}
+	if !equalStrings(from.Genres, to.Genres) {
+		changes["genres"] = FieldChange{From: from.Genres, To: to.Genres}
+	}
+	return changes
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply() copies the snapshot values of the revision onto the movie. The movie's ID
+// and Version are left alone so that a subsequent Update() still goes through the
+// usual optimistic-locking check.
+func (rev *MovieRevision) Apply(movie *Movie) {
+	movie.Title = rev.Title
+	movie.Year = rev.Year
+	movie.Runtime = rev.Runtime
+	movie.Genres = rev.Genres
+}
+
+type RevisionModel struct {
+	DB Handle
+}
+
+// Insert() records the current state of the movie as a new revision. An editorID of 0
+// (the anonymous user) is stored as NULL.
+func (m RevisionModel) Insert(movie *Movie, editorID int64) error {
+	query := `
+INSERT INTO movie_revisions (movie_id, version, title, year, runtime, genres, editor_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	args := []interface{}{movie.ID, movie.Version, movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), nullEditor(editorID)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// The history of a movie in the trash is hidden along with the movie itself, so that
+// it is only reachable again once the movie has been restored.
+const liveMovieSQL = `EXISTS (SELECT 1 FROM movies WHERE movies.id = movie_revisions.movie_id AND movies.deleted_at IS NULL)`
+
+// nullEditor() returns the editor ID to store with a revision, with NULL for the
+// anonymous user.
+func nullEditor(editorID int64) *int64 {
+	if editorID > 0 {
+		return &editorID
+	}
+	return nil
+}
+
+// Get() returns a single revision of a movie.
+func (m RevisionModel) Get(movieID int64, version int32) (*MovieRevision, error) {
+	if movieID < 1 || version < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT movie_id, version, title, year, runtime, genres, editor_id, created_at
+FROM movie_revisions
+WHERE movie_id = $1 AND version = $2 AND ` + liveMovieSQL
+
+	var rev MovieRevision
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, movieID, version).Scan(
+		&rev.MovieID,
+		&rev.Version,
+		&rev.Title,
+		&rev.Year,
+		&rev.Runtime,
+		pq.Array(&rev.Genres),
+		&rev.EditorID,
+		&rev.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &rev, nil
+}
+
+// GetAllForMovie() returns a page of revisions for a movie, newest first.
+func (m RevisionModel) GetAllForMovie(movieID int64, filters Filters) ([]*MovieRevision, Metadata, error) {
+	query := `
+SELECT count(*) OVER(), movie_id, version, title, year, runtime, genres, editor_id, created_at
+FROM movie_revisions
+WHERE movie_id = $1 AND ` + liveMovieSQL + `
+ORDER BY version DESC
+LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	revisions := []*MovieRevision{}
+
+	for rows.Next() {
+		var rev MovieRevision
+		err := rows.Scan(
+			&totalRecords,
+			&rev.MovieID,
+			&rev.Version,
+			&rev.Title,
+			&rev.Year,
+			&rev.Runtime,
+			pq.Array(&rev.Genres),
+			&rev.EditorID,
+			&rev.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		revisions = append(revisions, &rev)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return revisions, metadata, nil
+}
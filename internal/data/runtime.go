@@ -1,10 +1,18 @@
 package data
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// ErrInvalidRuntimeFormat is returned by UnmarshalJSON() and ParseRuntime() when a runtime
+// isn't in one of the accepted formats.
+var ErrInvalidRuntimeFormat = errors.New(`invalid runtime format, use "102 mins", "1h42m" or a number of minutes`)
+
 // Declare a custom Runtime type, which has the underlying type int32 (the same as our
 // Movie struct field).
 type Runtime int32
@@ -21,3 +29,65 @@ func (r Runtime) MarshalJSON() ([]byte, error) {
 	// Convert the quoted string value to a byte slice and return it.
 	return []byte(quotedJSONValue), nil
 }
+
+// Implement an UnmarshalJSON() method on the Runtime type so that it satisfies the
+// json.Unmarshaler interface. It accepts the "<runtime> mins" strings produced by
+// MarshalJSON(), as well as a bare JSON number and a Go duration string such as
+// "1h42m". Anything else is an ErrInvalidRuntimeFormat.
+//
+// IMPORTANT: Because UnmarshalJSON() needs to modify the receiver (our Runtime type),
+// we must use a pointer receiver for this to work correctly.
+func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
+	// As with the built-in types, null leaves the value unchanged.
+	if string(jsonValue) == "null" {
+		return nil
+	}
+	// A bare number of minutes, e.g. 102.
+	if len(jsonValue) > 0 && jsonValue[0] != '"' {
+		i, err := strconv.ParseInt(string(jsonValue), 10, 32)
+		if err != nil {
+			return ErrInvalidRuntimeFormat
+		}
+		*r = Runtime(i)
+		return nil
+	}
+
+	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
+	if err != nil {
+		return ErrInvalidRuntimeFormat
+	}
+
+	runtime, err := ParseRuntime(unquotedJSONValue)
+	if err != nil {
+		return err
+	}
+	*r = runtime
+	return nil
+}
+
+// ParseRuntime() parses a runtime written as "<runtime> mins" (or "1 min"), as a
+// duration in whole minutes such as "1h42m", or as a plain number of minutes.
+func ParseRuntime(s string) (Runtime, error) {
+	s = strings.TrimSpace(s)
+
+	parts := strings.Fields(s)
+	switch {
+	case len(parts) == 2 && (parts[1] == "mins" || parts[1] == "min"):
+		s = parts[0]
+	case len(parts) != 1:
+		return 0, ErrInvalidRuntimeFormat
+	}
+
+	if i, err := strconv.ParseInt(s, 10, 32); err == nil {
+		return Runtime(i), nil
+	}
+	if len(parts) == 2 {
+		return 0, ErrInvalidRuntimeFormat
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d%time.Minute != 0 || d/time.Minute > math.MaxInt32 {
+		return 0, ErrInvalidRuntimeFormat
+	}
+	return Runtime(d / time.Minute), nil
+}
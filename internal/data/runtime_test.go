@@ -0,0 +1,101 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseRuntime(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Runtime
+		wantErr bool
+	}{
+		{input: "102 mins", want: 102},
+		{input: "1 min", want: 1},
+		{input: "  102 mins ", want: 102},
+		{input: "102", want: 102},
+		{input: "1h42m", want: 102},
+		{input: "90m", want: 90},
+		{input: "2h", want: 120},
+		{input: "102 minutes", wantErr: true},
+		{input: "1h42m mins", wantErr: true},
+		{input: "1h42m30s", wantErr: true},
+		{input: "102 mins long", wantErr: true},
+		{input: "", wantErr: true},
+		{input: "abc", wantErr: true},
+		{input: "99999999999", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRuntime(tt.input)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidRuntimeFormat) {
+				t.Errorf("ParseRuntime(%q) error = %v; want ErrInvalidRuntimeFormat", tt.input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRuntime(%q) unexpected error: %v", tt.input, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRuntime(%q) = %d; want %d", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestRuntimeUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Runtime
+		wantErr bool
+	}{
+		{input: `"102 mins"`, want: 102},
+		{input: `"1h42m"`, want: 102},
+		{input: `102`, want: 102},
+		{input: `null`, want: 7},
+		{input: `102.5`, wantErr: true},
+		{input: `"102 minutes"`, wantErr: true},
+		{input: `true`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		// Start from a non-zero value, so that null can be seen to leave it alone.
+		got := Runtime(7)
+		err := got.UnmarshalJSON([]byte(tt.input))
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidRuntimeFormat) {
+				t.Errorf("UnmarshalJSON(%s) error = %v; want ErrInvalidRuntimeFormat", tt.input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("UnmarshalJSON(%s) unexpected error: %v", tt.input, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("UnmarshalJSON(%s) = %d; want %d", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestRuntimeRoundTrip(t *testing.T) {
+	js, err := json.Marshal(Runtime(102))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(js) != `"102 mins"` {
+		t.Errorf("Marshal(102) = %s; want %q", js, "102 mins")
+	}
+
+	var r Runtime
+	err = json.Unmarshal(js, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != 102 {
+		t.Errorf("round trip = %d; want 102", r)
+	}
+}
@@ -0,0 +1,61 @@
+package data
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// similarityThreshold is the minimum pg_trgm word_similarity() for a fuzzy match. It's
+// low enough to catch a couple of transposed letters ("godfahter") without matching
+// unrelated titles.
+const similarityThreshold = 0.3
+
+// A Suggestion is a single autocomplete result.
+type Suggestion struct {
+	ID    int64   `json:"id"`
+	Text  string  `json:"text"`
+	Score float64 `json:"score"`
+}
+
+// likePrefix() escapes the LIKE wildcards in s and appends a trailing "%", so the
+// client's input is only ever matched as a literal prefix.
+func likePrefix(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return replacer.Replace(s) + "%"
+}
+
+// suggest() runs an autocomplete query against a text expression of a table. Prefix
+// matches come first, then the rest by trigram similarity. The expression and the
+// extra WHERE condition are fixed strings from our own code, never client input.
+func suggest(db Handle, table, expr, where, q string, limit int) ([]*Suggestion, error) {
+	query := `
+SELECT id, ` + expr + `, GREATEST(similarity(` + expr + `, $1), word_similarity($1, ` + expr + `))::float8 AS score
+FROM ` + table + `
+WHERE (` + expr + ` ILIKE $2 OR word_similarity($1, ` + expr + `) >= $3) AND ` + where + `
+ORDER BY (` + expr + ` ILIKE $2) DESC, score DESC, ` + expr + ` ASC
+LIMIT $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, query, q, likePrefix(q), similarityThreshold, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suggestions := []*Suggestion{}
+	for rows.Next() {
+		var suggestion Suggestion
+		err := rows.Scan(&suggestion.ID, &suggestion.Text, &suggestion.Score)
+		if err != nil {
+			return nil, err
+		}
+		suggestions = append(suggestions, &suggestion)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return suggestions, nil
+}
@@ -0,0 +1,202 @@
+package data
+
+import (
+	"context"
+	"github.com/lib/pq"
+	"time"
+)
+
+// similarNeighbors is the number of most similar movies kept per movie.
+const similarNeighbors = 50
+
+// A ScoredMovie is a movie returned by the similar movies and recommendations queries,
+// with the score it was ranked by.
+type ScoredMovie struct {
+	Movie *Movie  `json:"movie"`
+	Score float64 `json:"score"`
+}
+
+// SimilarityModel reads and maintains movie_similarities, a precomputed table of the
+// most similar movies for each movie. It's rebuilt periodically in the background by
+// Refresh(), so requests only ever read from it.
+type SimilarityModel struct {
+	DB Handle
+}
+
+// refreshSimilaritiesSQL scores every pair of movies (outside the trash) that share a
+// genre or are liked by the same users, and keeps the best similarNeighbors pairs per
+// movie. A user "likes" a movie if they rated it 7 or more, or put it on a watchlist.
+// The score is a weighted sum of:
+//
+//   - genre overlap: the Jaccard index of the two genre lists,
+//   - year proximity: 1 for the same year, falling off with the distance in years,
+//   - co-likes: the number of users liking both, damped so a handful of users
+//     counts for a lot and hundreds don't count for much more.
+//
+// Pairs are compared in a single pass, which is fine for a catalog of this size.
+const refreshSimilaritiesSQL = `
+WITH live AS (
+    SELECT id, year, genres FROM movies WHERE deleted_at IS NULL
+),
+likes AS (
+    SELECT user_id, movie_id FROM reviews WHERE rating >= 7
+    UNION
+    SELECT watchlists.user_id, watchlist_entries.movie_id
+    FROM watchlist_entries
+    INNER JOIN watchlists ON watchlists.id = watchlist_entries.watchlist_id
+),
+colikes AS (
+    SELECT a.movie_id, b.movie_id AS similar_id, count(*) AS users
+    FROM likes a
+    INNER JOIN likes b ON b.user_id = a.user_id AND b.movie_id <> a.movie_id
+    GROUP BY a.movie_id, b.movie_id
+),
+pairs AS (
+    SELECT m.id AS movie_id, s.id AS similar_id,
+        0.5 * COALESCE(
+            cardinality(ARRAY(SELECT unnest(m.genres) INTERSECT SELECT unnest(s.genres)))::float8
+            / NULLIF(cardinality(ARRAY(SELECT unnest(m.genres) UNION SELECT unnest(s.genres))), 0), 0)
+        + 0.2 * (1.0 / (1.0 + abs(m.year - s.year) / 5.0))
+        + 0.3 * (COALESCE(colikes.users, 0) / (COALESCE(colikes.users, 0) + 3.0)) AS score
+    FROM live m
+    INNER JOIN live s ON s.id <> m.id
+    LEFT JOIN colikes ON colikes.movie_id = m.id AND colikes.similar_id = s.id
+    WHERE m.genres && s.genres OR colikes.users IS NOT NULL
+),
+ranked AS (
+    SELECT movie_id, similar_id, score,
+        row_number() OVER (PARTITION BY movie_id ORDER BY score DESC, similar_id ASC) AS n
+    FROM pairs
+)
+INSERT INTO movie_similarities (movie_id, similar_id, score)
+SELECT movie_id, similar_id, score
+FROM ranked
+WHERE n <= $1`
+
+// Refresh() rebuilds the similarity table in a single transaction, so readers see
+// either the old or the new table, never a partial one. It returns the number of
+// pairs stored.
+func (m SimilarityModel) Refresh() (int64, error) {
+	// This is a batch job over the whole catalog, so it gets more time than a request.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM movie_similarities`)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, refreshSimilaritiesSQL, similarNeighbors)
+	if err != nil {
+		return 0, err
+	}
+	pairs, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return pairs, tx.Commit()
+}
+
+// GetSimilar() returns up to limit movies most similar to the given one.
+func (m SimilarityModel) GetSimilar(movieID int64, limit int) ([]*ScoredMovie, error) {
+	query := `
+SELECT movies.id, movies.created_at, movies.title, movies.year, movies.runtime, movies.genres, movies.version,
+    movies.poster, movies.backdrop, movie_similarities.score
+FROM movie_similarities
+INNER JOIN movies ON movies.id = movie_similarities.similar_id
+WHERE movie_similarities.movie_id = $1 AND movies.deleted_at IS NULL
+ORDER BY movie_similarities.score DESC, movies.id ASC
+LIMIT $2`
+
+	return m.query(query, movieID, limit)
+}
+
+// GetRecommendations() returns up to limit movies for a user, by item-based
+// collaborative filtering: every movie the user likes contributes its similar movies,
+// and the movies with the highest total are recommended. As in the co-likes of
+// Refresh(), a movie is liked if the user rated it 7 or more (weighted by the rating)
+// or put it on a watchlist without rating it (weighted 0.7); a low rating is never a
+// positive signal. Movies the user has already rated or put on a watchlist are left out.
+func (m SimilarityModel) GetRecommendations(userID int64, limit int) ([]*ScoredMovie, error) {
+	query := `
+WITH rated AS (
+    SELECT movie_id, rating FROM reviews WHERE user_id = $1
+),
+watchlisted AS (
+    SELECT watchlist_entries.movie_id
+    FROM watchlist_entries
+    INNER JOIN watchlists ON watchlists.id = watchlist_entries.watchlist_id
+    WHERE watchlists.user_id = $1
+),
+seen AS (
+    SELECT movie_id FROM rated
+    UNION
+    SELECT movie_id FROM watchlisted
+),
+liked AS (
+    SELECT movie_id, max(rating) / 10.0 AS weight FROM rated WHERE rating >= 7 GROUP BY movie_id
+    UNION ALL
+    SELECT DISTINCT movie_id, 0.7 FROM watchlisted WHERE movie_id NOT IN (SELECT movie_id FROM rated)
+),
+candidates AS (
+    SELECT movie_similarities.similar_id AS movie_id, sum(liked.weight * movie_similarities.score) AS score
+    FROM liked
+    INNER JOIN movie_similarities ON movie_similarities.movie_id = liked.movie_id
+    WHERE movie_similarities.similar_id NOT IN (SELECT movie_id FROM seen)
+    GROUP BY movie_similarities.similar_id
+)
+SELECT movies.id, movies.created_at, movies.title, movies.year, movies.runtime, movies.genres, movies.version,
+    movies.poster, movies.backdrop, candidates.score
+FROM candidates
+INNER JOIN movies ON movies.id = candidates.movie_id
+WHERE movies.deleted_at IS NULL
+ORDER BY candidates.score DESC, movies.id ASC
+LIMIT $2`
+
+	return m.query(query, userID, limit)
+}
+
+// query() runs one of the scored movie queries above.
+func (m SimilarityModel) query(query string, args ...interface{}) ([]*ScoredMovie, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scored := []*ScoredMovie{}
+	for rows.Next() {
+		var movie Movie
+		var score float64
+		err := rows.Scan(
+			&movie.ID,
+			&movie.CreatedAt,
+			&movie.Title,
+			&movie.Year,
+			&movie.Runtime,
+			pq.Array(&movie.Genres),
+			&movie.Version,
+			&movie.Poster,
+			&movie.Backdrop,
+			&score,
+		)
+		if err != nil {
+			return nil, err
+		}
+		scored = append(scored, &ScoredMovie{Movie: &movie, Score: score})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return scored, nil
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/base32"
 	"github.com/asd/asd/internal/validator"
 	"time"
@@ -73,7 +72,7 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 
 // Define the TokenModel type.
 type TokenModel struct {
-	DB *sql.DB
+	DB Handle
 }
 
 // The New() method is a shortcut which creates a new Token struct and then inserts the
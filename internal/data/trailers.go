@@ -3,49 +3,134 @@ package data
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/lib/pq"
 	"time"
 )
 
 type Trailer struct {
 	ID          int64  `json:"id"`
+	MovieID     int64  `json:"movie_id,omitempty"`
 	TrailerName string `json:"trailer_name"`
 	Duration    int32  `json:"duration,omitempty"`
 	PremierDate string `json:"premier_date,omitempty"`
 	Version     int32  `json:"version"`
+	// Set once a video file has been uploaded. The file itself is served from
+	// /v1/trailers/:id/file.
+	FileKey    string `json:"-"`
+	FileSize   int64  `json:"file_size,omitempty"`
+	FileType   string `json:"file_type,omitempty"`
+	FileSHA256 string `json:"file_sha256,omitempty"`
+	// How well the trailer matched the name search, only set by GetAll().
+	Relevance float64 `json:"relevance,omitempty"`
 }
 
 type TrailerModel struct {
-	DB *sql.DB
+	DB Handle
 }
 
 func (t TrailerModel) Insert(trailer *Trailer) error {
 
 	query := `
-INSERT INTO trailers (trailer_name, duration, premier_date)
-VALUES ($1, $2, $3)
+INSERT INTO trailers (trailer_name, duration, premier_date, movie_id)
+VALUES ($1, $2, $3, NULLIF($4, 0))
 RETURNING id, version`
 	// Create an args slice containing the values for the placeholder parameters from
 	// the movie struct. Declaring this slice immediately next to our SQL query helps to
 	// make it nice and clear *what values are being used where* in the query.
-	args := []interface{}{trailer.TrailerName, trailer.Duration, trailer.PremierDate}
+	args := []interface{}{trailer.TrailerName, trailer.Duration, trailer.PremierDate, trailer.MovieID}
 	// Use the QueryRow() method to execute the SQL query on our connection pool,
 	// passing in the args slice as a variadic parameter and scanning the system-
 	// generated id, created_at and version values into the movie struct.
-	return t.DB.QueryRow(query, args...).Scan(&trailer.ID, &trailer.Version)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return t.DB.QueryRowContext(ctx, query, args...).Scan(&trailer.ID, &trailer.Version)
+}
+
+func (t TrailerModel) Get(id int64) (*Trailer, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT id, COALESCE(movie_id, 0), trailer_name, duration, premier_date, version, file_key, file_size, file_type, file_sha256
+FROM trailers
+WHERE id = $1`
+
+	var trailer Trailer
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := t.DB.QueryRowContext(ctx, query, id).Scan(
+		&trailer.ID,
+		&trailer.MovieID,
+		&trailer.TrailerName,
+		&trailer.Duration,
+		&trailer.PremierDate,
+		&trailer.Version,
+		&trailer.FileKey,
+		&trailer.FileSize,
+		&trailer.FileType,
+		&trailer.FileSHA256,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &trailer, nil
+}
+
+// SetFile() records the video file of a trailer and returns the blob key of the file it
+// replaced, if any, so that the caller can delete it.
+func (t TrailerModel) SetFile(trailer *Trailer) (string, error) {
+	query := `
+UPDATE trailers
+SET file_key = $1, file_size = $2, file_type = $3, file_sha256 = $4, version = version + 1
+FROM (SELECT id, file_key FROM trailers WHERE id = $5 FOR UPDATE) AS old
+WHERE trailers.id = old.id
+RETURNING old.file_key, trailers.version`
+	args := []interface{}{trailer.FileKey, trailer.FileSize, trailer.FileType, trailer.FileSHA256, trailer.ID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var oldKey string
+	err := t.DB.QueryRowContext(ctx, query, args...).Scan(&oldKey, &trailer.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+	return oldKey, nil
 }
 
 func (t TrailerModel) GetAll(trailer_name string, filters Filters) ([]*Trailer, error) {
+	orderBy, err := filters.orderBy()
+	if err != nil {
+		return nil, err
+	}
 	query := fmt.Sprintf(`
-SELECT id, trailer_name, duration, premier_date, version
+SELECT id, COALESCE(movie_id, 0), trailer_name, duration, premier_date, version, file_size, file_type, file_sha256,
+    CASE WHEN $1 = '' THEN 0
+        ELSE GREATEST(ts_rank(to_tsvector('english', trailer_name), plainto_tsquery('english', $1)), word_similarity($1, trailer_name))
+    END::float8 AS relevance
 FROM trailers
-WHERE (to_tsvector('english', trailer_name) @@ plainto_tsquery('english', $1) OR $1 = '')
-ORDER BY %s %s, id ASC`, filters.sortColumn(), filters.sortDirection())
+WHERE (to_tsvector('english', trailer_name) @@ plainto_tsquery('english', $1) OR word_similarity($1, trailer_name) >= $2 OR $1 = '')
+ORDER BY %s`, orderBy)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{trailer_name}
+	args := []interface{}{trailer_name, similarityThreshold}
 
 	rows, err := t.DB.QueryContext(ctx, query, args...)
 	if err != nil {
@@ -63,10 +148,15 @@ ORDER BY %s %s, id ASC`, filters.sortColumn(), filters.sortDirection())
 		// using the pq.Array() adapter on the genres field here.
 		err := rows.Scan(
 			&trailer.ID,
+			&trailer.MovieID,
 			&trailer.TrailerName,
 			&trailer.Duration,
 			&trailer.PremierDate,
 			&trailer.Version,
+			&trailer.FileSize,
+			&trailer.FileType,
+			&trailer.FileSHA256,
+			&trailer.Relevance,
 		)
 		if err != nil {
 			return nil, err
@@ -80,3 +170,47 @@ ORDER BY %s %s, id ASC`, filters.sortColumn(), filters.sortDirection())
 
 	return trailers, nil
 }
+
+// Suggest() returns up to limit trailer names for autocompletion.
+func (t TrailerModel) Suggest(q string, limit int) ([]*Suggestion, error) {
+	return suggest(t.DB, "trailers", "trailer_name", "TRUE", q, limit)
+}
+
+// GetAllForMovies() returns the trailers of each of the given movies, keyed by movie ID.
+func (t TrailerModel) GetAllForMovies(movieIDs []int64) (map[int64][]*Trailer, error) {
+	query := `
+SELECT id, movie_id, trailer_name, duration, premier_date, version
+FROM trailers
+WHERE movie_id = ANY($1)
+ORDER BY movie_id, id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := t.DB.QueryContext(ctx, query, pq.Array(movieIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trailers := make(map[int64][]*Trailer)
+	for rows.Next() {
+		var trailer Trailer
+		err := rows.Scan(
+			&trailer.ID,
+			&trailer.MovieID,
+			&trailer.TrailerName,
+			&trailer.Duration,
+			&trailer.PremierDate,
+			&trailer.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		trailers[trailer.MovieID] = append(trailers[trailer.MovieID], &trailer)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return trailers, nil
+}
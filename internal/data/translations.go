@@ -0,0 +1,208 @@
+package data
+
+import (
+	"context"
+	"github.com/asd/asd/internal/validator"
+	"github.com/lib/pq"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LocaleRX matches a lower-case BCP 47 language tag such as "de" or "pt-br".
+var LocaleRX = regexp.MustCompile("^[a-z]{2,3}(-[a-z0-9]{2,8})*$")
+
+// searchConfigs maps languages to the Postgres text search configuration used for
+// titles in that language. Languages without a stemmer of their own use "simple".
+var searchConfigs = map[string]string{
+	"da": "danish",
+	"de": "german",
+	"en": "english",
+	"es": "spanish",
+	"fi": "finnish",
+	"fr": "french",
+	"hu": "hungarian",
+	"it": "italian",
+	"nl": "dutch",
+	"no": "norwegian",
+	"pt": "portuguese",
+	"ro": "romanian",
+	"ru": "russian",
+	"sv": "swedish",
+	"tr": "turkish",
+}
+
+// SearchConfig() returns the text search configuration for a locale, based on its
+// language subtag ("pt-br" uses "portuguese").
+func SearchConfig(locale string) string {
+	language := strings.SplitN(locale, "-", 2)[0]
+	if config, ok := searchConfigs[language]; ok {
+		return config
+	}
+	return "simple"
+}
+
+// A MovieTranslation holds the title (and an optional synopsis) of a movie in one
+// locale.
+type MovieTranslation struct {
+	MovieID   int64     `json:"-"`
+	Locale    string    `json:"locale"`
+	Title     string    `json:"title"`
+	Synopsis  string    `json:"synopsis,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type TranslationModel struct {
+	DB Handle
+}
+
+func ValidateTranslation(v *validator.Validator, translation *MovieTranslation) {
+	v.Check(validator.Matches(translation.Locale, LocaleRX), "locale", "must be a language tag such as \"de\" or \"pt-br\"")
+	v.Check(translation.Title != "", "title", "must be provided")
+	v.Check(len(translation.Title) <= 500, "title", "must not be more than 500 bytes long")
+	v.Check(len(translation.Synopsis) <= 10_000, "synopsis", "must not be more than 10000 bytes long")
+}
+
+// Upsert() saves the translation for its movie and locale, replacing any existing
+// one. It reports whether a new translation was created.
+func (m TranslationModel) Upsert(translation *MovieTranslation) (bool, error) {
+	query := `
+INSERT INTO movie_translations (movie_id, locale, title, synopsis, search_config)
+VALUES ($1, $2, $3, $4, $5::regconfig)
+ON CONFLICT (movie_id, locale) DO UPDATE
+SET title = EXCLUDED.title, synopsis = EXCLUDED.synopsis, search_config = EXCLUDED.search_config, updated_at = NOW()
+RETURNING updated_at, (xmax = 0)`
+	args := []interface{}{
+		translation.MovieID,
+		translation.Locale,
+		translation.Title,
+		translation.Synopsis,
+		SearchConfig(translation.Locale),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// xmax is zero for a freshly inserted row and set for one updated by ON CONFLICT.
+	var created bool
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&translation.UpdatedAt, &created)
+	return created, err
+}
+
+func (m TranslationModel) GetAllForMovie(movieID int64) ([]*MovieTranslation, error) {
+	query := `
+SELECT movie_id, locale, title, synopsis, updated_at
+FROM movie_translations
+WHERE movie_id = $1
+ORDER BY locale ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	translations := []*MovieTranslation{}
+	for rows.Next() {
+		var translation MovieTranslation
+		err := rows.Scan(
+			&translation.MovieID,
+			&translation.Locale,
+			&translation.Title,
+			&translation.Synopsis,
+			&translation.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		translations = append(translations, &translation)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return translations, nil
+}
+
+func (m TranslationModel) Delete(movieID int64, locale string) error {
+	query := `
+DELETE FROM movie_translations
+WHERE movie_id = $1 AND locale = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, movieID, locale)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Localize() replaces the title of each movie with its translation in the first of
+// the locales (in order of preference) that the movie has one for. The original title
+// is kept in OriginalTitle. Movies without a matching translation are left as they
+// are. It reports the locales that were used.
+func (m TranslationModel) Localize(movies []*Movie, locales []string) ([]string, error) {
+	if len(movies) == 0 || len(locales) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]int64, 0, len(movies))
+	for _, movie := range movies {
+		ids = append(ids, movie.ID)
+	}
+
+	query := `
+SELECT DISTINCT ON (movie_id) movie_id, locale, title, synopsis
+FROM movie_translations
+WHERE movie_id = ANY($1) AND locale = ANY($2)
+ORDER BY movie_id, array_position($2, locale)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(ids), pq.Array(locales))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	translations := make(map[int64]MovieTranslation)
+	for rows.Next() {
+		var translation MovieTranslation
+		err := rows.Scan(&translation.MovieID, &translation.Locale, &translation.Title, &translation.Synopsis)
+		if err != nil {
+			return nil, err
+		}
+		translations[translation.MovieID] = translation
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var used []string
+	for _, movie := range movies {
+		translation, ok := translations[movie.ID]
+		if !ok {
+			continue
+		}
+		movie.OriginalTitle = movie.Title
+		movie.Title = translation.Title
+		movie.Synopsis = translation.Synopsis
+		movie.Locale = translation.Locale
+		if !validator.In(translation.Locale, used...) {
+			used = append(used, translation.Locale)
+		}
+	}
+	return used, nil
+}
@@ -31,7 +31,7 @@ func (u *User) IsAnonymous() bool {
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB Handle
 }
 
 // Create a custom password type which is a struct containing the plaintext and hashed
@@ -0,0 +1,360 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/asd/asd/internal/validator"
+	"github.com/lib/pq"
+	"time"
+)
+
+var (
+	ErrDuplicateWatchlist = errors.New("duplicate watchlist")
+	ErrDuplicateEntry     = errors.New("duplicate watchlist entry")
+)
+
+// A Watchlist is a named, ordered list of movies belonging to one user (for example
+// "Favorites" or "To watch").
+type Watchlist struct {
+	ID         int64     `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	UserID     int64     `json:"-"`
+	Name       string    `json:"name"`
+	EntryCount int32     `json:"entry_count"`
+	Version    int32     `json:"version"`
+}
+
+// A WatchlistEntry is a movie on a watchlist. The title and year are read from the
+// movies table for convenience.
+type WatchlistEntry struct {
+	WatchlistID int64     `json:"-"`
+	MovieID     int64     `json:"movie_id"`
+	Title       string    `json:"title"`
+	Year        int32     `json:"year,omitempty"`
+	Position    int32     `json:"position"`
+	Watched     bool      `json:"watched"`
+	AddedAt     time.Time `json:"added_at"`
+}
+
+type WatchlistModel struct {
+	DB Handle
+}
+
+func ValidateWatchlist(v *validator.Validator, watchlist *Watchlist) {
+	v.Check(watchlist.Name != "", "name", "must be provided")
+	v.Check(len(watchlist.Name) <= 100, "name", "must not be more than 100 bytes long")
+}
+
+func (m WatchlistModel) Insert(watchlist *Watchlist) error {
+	query := `
+INSERT INTO watchlists (user_id, name)
+VALUES ($1, $2)
+RETURNING id, created_at, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, watchlist.UserID, watchlist.Name).Scan(&watchlist.ID, &watchlist.CreatedAt, &watchlist.Version)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.As(err, &pqErr) && pqErr.Constraint == "watchlists_user_id_name_key":
+			return ErrDuplicateWatchlist
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Get() returns a watchlist, but only if it belongs to the given user, so a user can
+// never read somebody else's list by guessing IDs.
+func (m WatchlistModel) Get(id, userID int64) (*Watchlist, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT id, created_at, user_id, name, version,
+    (SELECT COUNT(*) FROM watchlist_entries WHERE watchlist_id = watchlists.id)
+FROM watchlists
+WHERE id = $1 AND user_id = $2`
+
+	var watchlist Watchlist
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&watchlist.ID,
+		&watchlist.CreatedAt,
+		&watchlist.UserID,
+		&watchlist.Name,
+		&watchlist.Version,
+		&watchlist.EntryCount,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &watchlist, nil
+}
+
+func (m WatchlistModel) GetAllForUser(userID int64, filters Filters) ([]*Watchlist, Metadata, error) {
+	orderBy, err := filters.orderBy()
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), id, created_at, user_id, name, version,
+    (SELECT COUNT(*) FROM watchlist_entries WHERE watchlist_id = watchlists.id)
+FROM watchlists
+WHERE user_id = $1
+ORDER BY %s
+LIMIT $2 OFFSET $3`, orderBy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	watchlists := []*Watchlist{}
+
+	for rows.Next() {
+		var watchlist Watchlist
+		err := rows.Scan(
+			&totalRecords,
+			&watchlist.ID,
+			&watchlist.CreatedAt,
+			&watchlist.UserID,
+			&watchlist.Name,
+			&watchlist.Version,
+			&watchlist.EntryCount,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		watchlists = append(watchlists, &watchlist)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return watchlists, metadata, nil
+}
+
+func (m WatchlistModel) Update(watchlist *Watchlist) error {
+	query := `
+UPDATE watchlists
+SET name = $1, version = version + 1
+WHERE id = $2 AND user_id = $3 AND version = $4
+RETURNING version`
+	args := []interface{}{watchlist.Name, watchlist.ID, watchlist.UserID, watchlist.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&watchlist.Version)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.As(err, &pqErr) && pqErr.Constraint == "watchlists_user_id_name_key":
+			return ErrDuplicateWatchlist
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete() removes a watchlist and (through the foreign key) all of its entries.
+func (m WatchlistModel) Delete(id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+DELETE FROM watchlists
+WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// AddEntry() puts a movie on a watchlist. If entry.Position is zero the movie is added
+// to the end of the list.
+func (m WatchlistModel) AddEntry(entry *WatchlistEntry) error {
+	query := `
+INSERT INTO watchlist_entries (watchlist_id, movie_id, position, watched)
+SELECT $1, $2, COALESCE(NULLIF($3, 0), (SELECT COALESCE(MAX(position), 0) + 1 FROM watchlist_entries WHERE watchlist_id = $1)), $4
+RETURNING position, added_at`
+	args := []interface{}{entry.WatchlistID, entry.MovieID, entry.Position, entry.Watched}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&entry.Position, &entry.AddedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		switch {
+		case errors.As(err, &pqErr) && pqErr.Constraint == "watchlist_entries_pkey":
+			return ErrDuplicateEntry
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// GetEntries() returns a page of the entries on a watchlist in list order. If watched
+// is not nil, only entries with that watched state are returned.
+func (m WatchlistModel) GetEntries(watchlistID int64, watched *bool, filters Filters) ([]*WatchlistEntry, Metadata, error) {
+	query := `
+SELECT count(*) OVER(), watchlist_entries.watchlist_id, watchlist_entries.movie_id, movies.title, movies.year,
+    watchlist_entries.position, watchlist_entries.watched, watchlist_entries.added_at
+FROM watchlist_entries
+INNER JOIN movies ON movies.id = watchlist_entries.movie_id
+WHERE watchlist_entries.watchlist_id = $1
+AND (watchlist_entries.watched = $2 OR $2 IS NULL)
+ORDER BY watchlist_entries.position ASC, watchlist_entries.added_at ASC
+LIMIT $3 OFFSET $4`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, watchlistID, watched, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*WatchlistEntry{}
+
+	for rows.Next() {
+		var entry WatchlistEntry
+		err := rows.Scan(
+			&totalRecords,
+			&entry.WatchlistID,
+			&entry.MovieID,
+			&entry.Title,
+			&entry.Year,
+			&entry.Position,
+			&entry.Watched,
+			&entry.AddedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		entries = append(entries, &entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return entries, metadata, nil
+}
+
+// UpdateEntry() saves the position and watched state of an entry.
+func (m WatchlistModel) UpdateEntry(entry *WatchlistEntry) error {
+	query := `
+UPDATE watchlist_entries
+SET position = $1, watched = $2
+WHERE watchlist_id = $3 AND movie_id = $4
+RETURNING added_at`
+	args := []interface{}{entry.Position, entry.Watched, entry.WatchlistID, entry.MovieID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&entry.AddedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// GetEntry() returns a single entry of a watchlist.
+func (m WatchlistModel) GetEntry(watchlistID, movieID int64) (*WatchlistEntry, error) {
+	query := `
+SELECT watchlist_entries.watchlist_id, watchlist_entries.movie_id, movies.title, movies.year,
+    watchlist_entries.position, watchlist_entries.watched, watchlist_entries.added_at
+FROM watchlist_entries
+INNER JOIN movies ON movies.id = watchlist_entries.movie_id
+WHERE watchlist_entries.watchlist_id = $1 AND watchlist_entries.movie_id = $2`
+
+	var entry WatchlistEntry
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, watchlistID, movieID).Scan(
+		&entry.WatchlistID,
+		&entry.MovieID,
+		&entry.Title,
+		&entry.Year,
+		&entry.Position,
+		&entry.Watched,
+		&entry.AddedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &entry, nil
+}
+
+func (m WatchlistModel) DeleteEntry(watchlistID, movieID int64) error {
+	query := `
+DELETE FROM watchlist_entries
+WHERE watchlist_id = $1 AND movie_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, watchlistID, movieID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
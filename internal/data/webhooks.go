@@ -0,0 +1,461 @@
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/asd/asd/internal/validator"
+	"github.com/lib/pq"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Webhook events.
+const (
+	EventMovieCreated  = "movie.created"
+	EventMovieUpdated  = "movie.updated"
+	EventMovieDeleted  = "movie.deleted"
+	EventMovieRestored = "movie.restored"
+	EventUserActivated = "user.activated"
+)
+
+// WebhookEvents is every event a webhook can subscribe to.
+var WebhookEvents = []string{EventMovieCreated, EventMovieUpdated, EventMovieDeleted, EventMovieRestored, EventUserActivated}
+
+// Webhook delivery statuses.
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	// A delivery is given up on after this many attempts.
+	WebhookMaxAttempts = 8
+	// The delay before the first retry, doubled after every further failure.
+	webhookRetryBase = 30 * time.Second
+	webhookRetryMax  = 6 * time.Hour
+	// How long a claimed delivery is left alone before another dispatcher may try it,
+	// in case the one that claimed it died mid-request.
+	webhookClaimLease = 5 * time.Minute
+)
+
+// A Webhook is an endpoint which is sent a signed POST request for each of the events
+// it's subscribed to. The secret is only shown when the webhook is created.
+type Webhook struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Version   int32     `json:"version"`
+}
+
+// A WebhookDelivery is one event queued for (or sent to) one webhook. The deliveries
+// table is the outbox: events are written to it, and the dispatcher sends whatever is
+// due, so nothing is lost if the receiver or this server is down for a while.
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	CreatedAt      time.Time       `json:"created_at"`
+	WebhookID      int64           `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	// Filled in by ClaimDue() for the dispatcher.
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// GenerateWebhookSecret() returns a random secret for signing a webhook's payloads.
+func GenerateWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SignWebhookPayload() returns the hex HMAC-SHA256 of "<timestamp>.<payload>" with the
+// webhook's secret. Including the timestamp lets receivers reject replayed requests.
+func SignWebhookPayload(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookRetryDelay() returns how long to wait before the next attempt after the given
+// number of failed attempts: 30s, 1m, 2m, 4m and so on, up to 6 hours.
+func WebhookRetryDelay(attempts int) time.Duration {
+	delay := webhookRetryBase
+	for i := 1; i < attempts && delay < webhookRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > webhookRetryMax {
+		delay = webhookRetryMax
+	}
+	return delay
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	v.Check(webhook.URL != "", "url", "must be provided")
+	v.Check(len(webhook.URL) <= 2000, "url", "must not be more than 2000 bytes long")
+	u, err := url.Parse(webhook.URL)
+	v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url", "must be an absolute http or https URL")
+
+	v.Check(len(webhook.Events) >= 1, "events", "must contain at least 1 event")
+	v.Check(validator.Unique(webhook.Events), "events", "must not contain duplicate values")
+	for _, event := range webhook.Events {
+		if !validator.In(event, WebhookEvents...) {
+			v.AddError("events", "unknown event "+strconv.Quote(event))
+			break
+		}
+	}
+}
+
+type WebhookModel struct {
+	DB Handle
+}
+
+func (m WebhookModel) Insert(webhook *Webhook) error {
+	query := `
+INSERT INTO webhooks (url, secret, events)
+VALUES ($1, $2, $3)
+RETURNING id, created_at, active, version`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, webhook.URL, webhook.Secret, pq.Array(webhook.Events)).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.Active,
+		&webhook.Version,
+	)
+}
+
+// Get() returns a webhook without its secret.
+func (m WebhookModel) Get(id int64) (*Webhook, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+SELECT id, created_at, url, events, active, version
+FROM webhooks
+WHERE id = $1`
+
+	var webhook Webhook
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&webhook.ID,
+		&webhook.CreatedAt,
+		&webhook.URL,
+		pq.Array(&webhook.Events),
+		&webhook.Active,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &webhook, nil
+}
+
+// GetAll() returns every webhook, without their secrets.
+func (m WebhookModel) GetAll() ([]*Webhook, error) {
+	query := `
+SELECT id, created_at, url, events, active, version
+FROM webhooks
+ORDER BY id ASC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.CreatedAt,
+			&webhook.URL,
+			pq.Array(&webhook.Events),
+			&webhook.Active,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+func (m WebhookModel) Update(webhook *Webhook) error {
+	query := `
+UPDATE webhooks
+SET url = $1, events = $2, active = $3, version = version + 1
+WHERE id = $4 AND version = $5
+RETURNING version`
+
+	args := []interface{}{webhook.URL, pq.Array(webhook.Events), webhook.Active, webhook.ID, webhook.Version}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete() removes a webhook along with its delivery history.
+func (m WebhookModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// Enqueue() writes an event to the outbox, as one pending delivery for each active
+// webhook subscribed to it. The payload is the JSON body the webhooks will be sent.
+func (m WebhookModel) Enqueue(event string, payload []byte) error {
+	query := `
+INSERT INTO webhook_deliveries (webhook_id, event, payload)
+SELECT id, $1, $2
+FROM webhooks
+WHERE active AND $1 = ANY(events)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, event, payload)
+	return err
+}
+
+// ClaimDue() returns up to limit deliveries which are due, with the URL and secret of
+// their webhooks. They are pushed back by a lease so that a second dispatcher (or the
+// next poll) won't pick them up while they're being sent. Deliveries for webhooks that
+// have been deactivated stay pending until the webhook is active again.
+func (m WebhookModel) ClaimDue(limit int) ([]*WebhookDelivery, error) {
+	query := `
+UPDATE webhook_deliveries
+SET next_attempt_at = NOW() + $2 * interval '1 second'
+FROM webhooks
+WHERE webhooks.id = webhook_deliveries.webhook_id
+AND webhook_deliveries.id IN (
+    SELECT webhook_deliveries.id
+    FROM webhook_deliveries
+    INNER JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id
+    WHERE webhook_deliveries.status = 'pending' AND webhook_deliveries.next_attempt_at <= NOW() AND webhooks.active
+    ORDER BY webhook_deliveries.next_attempt_at ASC, webhook_deliveries.id ASC
+    LIMIT $1
+    FOR UPDATE OF webhook_deliveries SKIP LOCKED
+)
+RETURNING webhook_deliveries.id, webhook_deliveries.created_at, webhook_deliveries.webhook_id, webhook_deliveries.event,
+    webhook_deliveries.payload, webhook_deliveries.attempts, webhooks.url, webhooks.secret`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, limit, webhookClaimLease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		delivery := WebhookDelivery{Status: DeliveryPending}
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&delivery.Payload,
+			&delivery.Attempts,
+			&delivery.URL,
+			&delivery.Secret,
+		)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// RecordAttempt() saves the outcome of sending a delivery. A successful attempt marks it
+// succeeded. A failed one is retried after WebhookRetryDelay(), unless that was the
+// last attempt, in which case it's marked failed.
+func (m WebhookModel) RecordAttempt(delivery *WebhookDelivery, responseStatus int, attemptErr error) error {
+	delivery.Attempts++
+	delivery.ResponseStatus = responseStatus
+	delivery.Error = ""
+	now := time.Now()
+
+	switch {
+	case attemptErr == nil:
+		delivery.Status = DeliverySucceeded
+		delivery.DeliveredAt = &now
+	case delivery.Attempts >= WebhookMaxAttempts:
+		delivery.Status = DeliveryFailed
+		delivery.Error = attemptErr.Error()
+	default:
+		delivery.Error = attemptErr.Error()
+		delivery.NextAttemptAt = now.Add(WebhookRetryDelay(delivery.Attempts))
+	}
+
+	query := `
+UPDATE webhook_deliveries
+SET status = $1, attempts = $2, response_status = $3, error = $4, delivered_at = $5,
+    next_attempt_at = CASE WHEN $1 = 'pending' THEN $6 ELSE next_attempt_at END
+WHERE id = $7`
+
+	args := []interface{}{delivery.Status, delivery.Attempts, delivery.ResponseStatus, delivery.Error, delivery.DeliveredAt, delivery.NextAttemptAt, delivery.ID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// GetDeliveries() returns a page of a webhook's delivery history, newest first.
+func (m WebhookModel) GetDeliveries(webhookID int64, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	query := `
+SELECT count(*) OVER(), id, created_at, webhook_id, event, payload, status, attempts, next_attempt_at, response_status, error, delivered_at
+FROM webhook_deliveries
+WHERE webhook_id = $1
+ORDER BY id DESC
+LIMIT $2 OFFSET $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err := rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.CreatedAt,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&delivery.Payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.ResponseStatus,
+			&delivery.Error,
+			&delivery.DeliveredAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return deliveries, metadata, nil
+}
+
+// Redeliver() queues a fresh copy of one of a webhook's deliveries, whatever happened
+// to the original, and returns the new delivery. The original is left as it is in the
+// history.
+func (m WebhookModel) Redeliver(webhookID, deliveryID int64) (*WebhookDelivery, error) {
+	query := `
+INSERT INTO webhook_deliveries (webhook_id, event, payload)
+SELECT webhook_id, event, payload
+FROM webhook_deliveries
+WHERE webhook_id = $1 AND id = $2
+RETURNING id, created_at, webhook_id, event, payload, status, attempts, next_attempt_at`
+
+	var delivery WebhookDelivery
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, webhookID, deliveryID).Scan(
+		&delivery.ID,
+		&delivery.CreatedAt,
+		&delivery.WebhookID,
+		&delivery.Event,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &delivery, nil
+}
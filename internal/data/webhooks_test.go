@@ -0,0 +1,50 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWebhookRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 0, want: 30 * time.Second},
+		{attempts: 1, want: 30 * time.Second},
+		{attempts: 2, want: time.Minute},
+		{attempts: 3, want: 2 * time.Minute},
+		{attempts: 4, want: 4 * time.Minute},
+		{attempts: 10, want: 256 * time.Minute},
+		{attempts: 11, want: 6 * time.Hour},
+		{attempts: 1000, want: 6 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := WebhookRetryDelay(tt.attempts); got != tt.want {
+			t.Errorf("WebhookRetryDelay(%d) = %s; want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	payload := []byte(`{"event":"movie.created"}`)
+
+	// The expected value was computed independently as
+	// HMAC-SHA256("whsec_test", "1700000000.<payload>").
+	want := "44e0665cb4615bcc44842c8f1fd738359fbea1be8029214e0bd1308d193e044c"
+	if got := SignWebhookPayload("whsec_test", 1700000000, payload); got != want {
+		t.Errorf("SignWebhookPayload() = %s; want %s", got, want)
+	}
+
+	// The signature covers the secret, the timestamp and the payload.
+	if SignWebhookPayload("other", 1700000000, payload) == want {
+		t.Error("signature doesn't depend on the secret")
+	}
+	if SignWebhookPayload("whsec_test", 1700000001, payload) == want {
+		t.Error("signature doesn't depend on the timestamp")
+	}
+	if SignWebhookPayload("whsec_test", 1700000000, []byte(`{"event":"movie.deleted"}`)) == want {
+		t.Error("signature doesn't depend on the payload")
+	}
+}
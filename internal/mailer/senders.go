@@ -0,0 +1,158 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/asd/asd/internal/jsonlog"
+	"github.com/go-mail/mail/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// mailMessage() converts msg into a MIME message with a plain-text body and an HTML
+// alternative.
+func (msg *Message) mailMessage() *mail.Message {
+	// It's important to note that AddAlternative() should always be called *after*
+	// SetBody().
+	mm := mail.NewMessage()
+	mm.SetHeader("To", msg.To)
+	mm.SetHeader("From", msg.From)
+	mm.SetHeader("Subject", msg.Subject)
+	mm.SetDateHeader("Date", msg.Date)
+	mm.SetBody("text/plain", msg.PlainBody)
+	mm.AddAlternative("text/html", msg.HTMLBody)
+	return mm
+}
+
+// SMTP is a Sender which delivers messages to an SMTP server.
+type SMTP struct {
+	dialer *mail.Dialer
+}
+
+func NewSMTP(host string, port int, username, password string) *SMTP {
+	// Initialize a new mail.Dialer instance with the given SMTP server settings. We
+	// also configure this to use a 5-second timeout whenever we send an email.
+	dialer := mail.NewDialer(host, port, username, password)
+	dialer.Timeout = 5 * time.Second
+	return &SMTP{dialer: dialer}
+}
+
+// Send() opens a connection to the SMTP server, sends the message, then closes the
+// connection. If there is a timeout, it will return a "dial tcp: i/o timeout" error.
+// Failures aren't retried here: emails are sent from the job queue, which retries
+// them with backoff.
+func (s *SMTP) Send(msg *Message) error {
+	return s.dialer.DialAndSend(msg.mailMessage())
+}
+
+// File is a Sender which drops each message into a directory as an .eml file, which
+// can be opened with any mail client.
+type File struct {
+	dir string
+}
+
+// NewFile() returns a File sender writing to dir, creating the directory if needed.
+func NewFile(dir string) (*File, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &File{dir: dir}, nil
+}
+
+func (f *File) Send(msg *Message) error {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", msg.Date.UTC().Format("20060102T150405.000000000Z"), hex.EncodeToString(b))
+
+	// Write to a temporary file first and rename it into place, so that anything
+	// watching the directory never sees a partly written message.
+	tmp, err := os.CreateTemp(f.dir, ".eml-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = msg.mailMessage().WriteTo(tmp)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(f.dir, name))
+}
+
+// Memory is a Sender which keeps the most recent messages in memory instead of
+// delivering them, so that tests and the debug mail page can inspect them.
+type Memory struct {
+	mu       sync.Mutex
+	limit    int
+	messages []Message
+}
+
+// NewMemory() returns a Memory sender holding at most limit messages (or any number, if
+// limit is 0). Once it's full, the oldest message is dropped for each new one.
+func NewMemory(limit int) *Memory {
+	return &Memory{limit: limit}
+}
+
+func (m *Memory) Send(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, *msg)
+	if m.limit > 0 && len(m.messages) > m.limit {
+		m.messages = append([]Message(nil), m.messages[len(m.messages)-m.limit:]...)
+	}
+	return nil
+}
+
+// Messages() returns a copy of the captured messages, oldest first.
+func (m *Memory) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Message(nil), m.messages...)
+}
+
+// Reset() discards every captured message.
+func (m *Memory) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = nil
+}
+
+// Log is a Sender which only writes each message to the log. If includeBody is set, the
+// plain-text body is logged too, so that links such as activation tokens can still be
+// followed. As the body can hold secrets, that's only meant for development.
+type Log struct {
+	logger      *jsonlog.Logger
+	includeBody bool
+}
+
+func NewLog(logger *jsonlog.Logger, includeBody bool) *Log {
+	return &Log{logger: logger, includeBody: includeBody}
+}
+
+func (l *Log) Send(msg *Message) error {
+	properties := map[string]string{
+		"to":      msg.To,
+		"from":    msg.From,
+		"subject": msg.Subject,
+	}
+	if l.includeBody {
+		properties["body"] = msg.PlainBody
+	}
+	l.logger.PrintInfo("email not sent (log mailer)", properties)
+	return nil
+}
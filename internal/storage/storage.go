@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotExist   = errors.New("blob does not exist")
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+// A BlobStore stores binary objects such as images under slash-separated keys, for
+// example "posters/12/1f2e3d4c5b6a7988/small.jpg". The API only depends on this
+// interface, so the local filesystem store can be swapped for object storage.
+type BlobStore interface {
+	// Put() stores the contents of r under key, replacing any existing blob.
+	Put(key string, r io.Reader) error
+	// Open() returns the blob stored under key, or ErrNotExist.
+	Open(key string) (*Blob, error)
+	// Delete() removes the blob stored under key. Deleting a missing blob isn't an
+	// error.
+	Delete(key string) error
+	// DeletePrefix() removes every blob whose key starts with prefix + "/".
+	DeletePrefix(prefix string) error
+}
+
+// A Blob is an open stored object. It must be closed after use.
+type Blob struct {
+	io.ReadSeekCloser
+	Size    int64
+	ModTime time.Time
+}
+
+// ValidKey() reports whether key is a clean, relative, slash-separated path that can't
+// escape the root of a store.
+func ValidKey(key string) bool {
+	return key != "" && key != "." && path.Clean(key) == key && !path.IsAbs(key) &&
+		key != ".." && !strings.HasPrefix(key, "../") && !strings.Contains(key, `\`)
+}
+
+// Local is a BlobStore which keeps blobs as files below a root directory.
+type Local struct {
+	root string
+}
+
+// NewLocal() returns a Local store rooted at dir, creating the directory if needed.
+func NewLocal(dir string) (*Local, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &Local{root: dir}, nil
+}
+
+func (l *Local) path(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
+
+// Put() writes the blob to a temporary file first and renames it into place, so that
+// readers never see a partly written file.
+func (l *Local) Put(key string, r io.Reader) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	name := l.path(key)
+
+	err := os.MkdirAll(filepath.Dir(name), 0o755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (l *Local) Open(key string) (*Blob, error) {
+	if !ValidKey(key) {
+		return nil, ErrNotExist
+	}
+
+	f, err := os.Open(l.path(key))
+	if err != nil {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return nil, ErrNotExist
+		default:
+			return nil, err
+		}
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, ErrNotExist
+	}
+	return &Blob{ReadSeekCloser: f, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (l *Local) Delete(key string) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	err := os.Remove(l.path(key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (l *Local) DeletePrefix(prefix string) error {
+	if !ValidKey(prefix) {
+		return ErrInvalidKey
+	}
+	return os.RemoveAll(l.path(prefix))
+}
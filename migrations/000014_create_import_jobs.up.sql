@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS import_jobs (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    format text NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    total integer NOT NULL DEFAULT 0,
+    created integer NOT NULL DEFAULT 0,
+    failed integer NOT NULL DEFAULT 0,
+    results jsonb NOT NULL DEFAULT '[]',
+    error text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    finished_at timestamp(0) with time zone
+);
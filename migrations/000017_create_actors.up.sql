@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS actors (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    first_name text NOT NULL,
+    last_name text NOT NULL,
+    date_of_birth integer NOT NULL DEFAULT 0,
+    movies_casted text[] NOT NULL DEFAULT '{}',
+    version integer NOT NULL DEFAULT 1
+);
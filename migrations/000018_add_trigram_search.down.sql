@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS actors_name_trgm_idx;
+DROP INDEX IF EXISTS trailers_trailer_name_trgm_idx;
+DROP INDEX IF EXISTS movies_title_trgm_idx;
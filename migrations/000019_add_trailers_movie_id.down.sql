@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS trailers_movie_id_idx;
+
+ALTER TABLE trailers DROP COLUMN IF EXISTS movie_id;
@@ -0,0 +1,3 @@
+ALTER TABLE trailers ADD COLUMN IF NOT EXISTS movie_id bigint REFERENCES movies ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS trailers_movie_id_idx ON trailers (movie_id);
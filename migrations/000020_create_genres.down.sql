@@ -0,0 +1,2 @@
+-- Movie genres stay as slugs; the original spellings aren't restored.
+DROP TABLE IF EXISTS genres;
@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS genres (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    slug text NOT NULL UNIQUE,
+    name text NOT NULL,
+    aliases text[] NOT NULL DEFAULT '{}',
+    version integer NOT NULL DEFAULT 1
+);
+
+-- Seed the taxonomy from the genres already in use. The slug is the genre in lower
+-- case with every run of other characters replaced by a hyphen, the same as
+-- data.Slugify().
+INSERT INTO genres (slug, name)
+SELECT slug, min(genre)
+FROM (
+    SELECT DISTINCT genre, trim(both '-' from regexp_replace(lower(genre), '[^a-z0-9]+', '-', 'g')) AS slug
+    FROM movies, unnest(genres) AS genre
+) AS used
+WHERE slug <> ''
+GROUP BY slug;
+
+-- Store movie genres as slugs from now on, keeping their order and dropping the
+-- duplicates that spelling variants turn into.
+UPDATE movies SET genres = ARRAY(
+    SELECT slug
+    FROM (
+        SELECT trim(both '-' from regexp_replace(lower(genre), '[^a-z0-9]+', '-', 'g')) AS slug, min(n) AS n
+        FROM unnest(movies.genres) WITH ORDINALITY AS g(genre, n)
+        GROUP BY 1
+    ) AS slugs
+    WHERE slug <> ''
+    ORDER BY n
+);
@@ -0,0 +1,4 @@
+ALTER TABLE trailers DROP COLUMN IF EXISTS file_sha256;
+ALTER TABLE trailers DROP COLUMN IF EXISTS file_type;
+ALTER TABLE trailers DROP COLUMN IF EXISTS file_size;
+ALTER TABLE trailers DROP COLUMN IF EXISTS file_key;
@@ -0,0 +1,4 @@
+ALTER TABLE trailers ADD COLUMN IF NOT EXISTS file_key text NOT NULL DEFAULT '';
+ALTER TABLE trailers ADD COLUMN IF NOT EXISTS file_size bigint NOT NULL DEFAULT 0;
+ALTER TABLE trailers ADD COLUMN IF NOT EXISTS file_type text NOT NULL DEFAULT '';
+ALTER TABLE trailers ADD COLUMN IF NOT EXISTS file_sha256 text NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS movies_normalized_title_idx;
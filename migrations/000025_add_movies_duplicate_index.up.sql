@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS movies_normalized_title_idx ON movies ((regexp_replace(lower(title), '[^[:alnum:]]+', '', 'g')), year) WHERE deleted_at IS NULL;
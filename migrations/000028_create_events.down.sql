@@ -0,0 +1,6 @@
+DROP TRIGGER IF EXISTS trailers_events ON trailers;
+DROP TRIGGER IF EXISTS movies_events ON movies;
+DROP FUNCTION IF EXISTS record_trailer_event();
+DROP FUNCTION IF EXISTS record_movie_event();
+DROP TABLE IF EXISTS events;
+DROP FUNCTION IF EXISTS notify_event();
@@ -0,0 +1,86 @@
+CREATE TABLE IF NOT EXISTS events (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    type text NOT NULL,
+    permission text NOT NULL DEFAULT '',
+    payload jsonb NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS events_created_at_idx ON events (created_at);
+
+-- Every new event is announced on the "events" channel, with its ID as the payload.
+-- Notifications are only sent when the transaction commits.
+CREATE OR REPLACE FUNCTION notify_event() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('events', NEW.id::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER events_notify AFTER INSERT ON events
+FOR EACH ROW EXECUTE PROCEDURE notify_event();
+
+-- Moving a movie to the trash is reported as movie.deleted and taking it out again as
+-- movie.restored. Edits to movies in the trash aren't reported, and purging a movie
+-- from the trash is only reported to admins.
+CREATE OR REPLACE FUNCTION record_movie_event() RETURNS trigger AS $$
+DECLARE
+    event_type text;
+    event_permission text := '';
+    movie movies;
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        event_type := 'movie.created';
+        movie := NEW;
+    ELSIF TG_OP = 'DELETE' THEN
+        event_type := 'movie.purged';
+        event_permission := 'admin';
+        movie := OLD;
+    ELSIF OLD.deleted_at IS NULL AND NEW.deleted_at IS NOT NULL THEN
+        event_type := 'movie.deleted';
+        movie := NEW;
+    ELSIF OLD.deleted_at IS NOT NULL AND NEW.deleted_at IS NULL THEN
+        event_type := 'movie.restored';
+        movie := NEW;
+    ELSIF NEW.deleted_at IS NOT NULL THEN
+        RETURN NULL;
+    ELSE
+        event_type := 'movie.updated';
+        movie := NEW;
+    END IF;
+
+    INSERT INTO events (type, permission, payload)
+    VALUES (event_type, event_permission, jsonb_build_object(
+        'id', movie.id, 'title', movie.title, 'year', movie.year, 'version', movie.version));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER movies_events AFTER INSERT OR UPDATE OR DELETE ON movies
+FOR EACH ROW EXECUTE PROCEDURE record_movie_event();
+
+CREATE OR REPLACE FUNCTION record_trailer_event() RETURNS trigger AS $$
+DECLARE
+    event_type text;
+    trailer trailers;
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        event_type := 'trailer.created';
+        trailer := NEW;
+    ELSIF TG_OP = 'DELETE' THEN
+        event_type := 'trailer.deleted';
+        trailer := OLD;
+    ELSE
+        event_type := 'trailer.updated';
+        trailer := NEW;
+    END IF;
+
+    INSERT INTO events (type, payload)
+    VALUES (event_type, jsonb_build_object(
+        'id', trailer.id, 'trailer_name', trailer.trailer_name, 'movie_id', trailer.movie_id, 'version', trailer.version));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trailers_events AFTER INSERT OR UPDATE OR DELETE ON trailers
+FOR EACH ROW EXECUTE PROCEDURE record_trailer_event();
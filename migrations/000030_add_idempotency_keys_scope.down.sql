@@ -0,0 +1,5 @@
+DELETE FROM idempotency_keys WHERE user_id IS NULL;
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ALTER COLUMN user_id SET NOT NULL;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (user_id, key);
+ALTER TABLE idempotency_keys DROP COLUMN IF EXISTS scope;
@@ -0,0 +1,6 @@
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS scope text;
+UPDATE idempotency_keys SET scope = 'user:' || user_id;
+ALTER TABLE idempotency_keys ALTER COLUMN scope SET NOT NULL;
+ALTER TABLE idempotency_keys ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (scope, key);
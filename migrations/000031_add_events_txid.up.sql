@@ -0,0 +1,4 @@
+-- The ID of the transaction which wrote each event. Event IDs are allocated before the
+-- transaction commits, so they don't become visible in order; readers only take events
+-- from transactions older than every transaction still in progress.
+ALTER TABLE events ADD COLUMN IF NOT EXISTS txid bigint NOT NULL DEFAULT txid_current();
@@ -0,0 +1,4 @@
+-- Asynchronous imports are run from the job queue, so the uploaded file is kept with the
+-- import until it has been processed.
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS source bytea;
+ALTER TABLE import_jobs ADD COLUMN IF NOT EXISTS allow_duplicate boolean NOT NULL DEFAULT false;
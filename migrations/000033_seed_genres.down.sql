@@ -0,0 +1,7 @@
+DELETE FROM genres
+WHERE slug IN (
+    'action', 'adventure', 'animation', 'comedy', 'crime', 'documentary', 'drama',
+    'family', 'fantasy', 'history', 'horror', 'musical', 'mystery', 'romance',
+    'sci-fi', 'thriller', 'war', 'western'
+)
+AND NOT EXISTS (SELECT 1 FROM movies WHERE genres.slug = ANY(movies.genres));
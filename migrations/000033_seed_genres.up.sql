@@ -0,0 +1,32 @@
+-- Seed a starter taxonomy so that a fresh database can accept movies. Genres already
+-- present, whether by slug or by one of the seeded aliases, are left alone.
+INSERT INTO genres (slug, name, aliases)
+SELECT seed.slug, seed.name, seed.aliases
+FROM (VALUES
+    ('action', 'Action', '{}'::text[]),
+    ('adventure', 'Adventure', '{}'),
+    ('animation', 'Animation', '{animated}'),
+    ('comedy', 'Comedy', '{}'),
+    ('crime', 'Crime', '{}'),
+    ('documentary', 'Documentary', '{}'),
+    ('drama', 'Drama', '{}'),
+    ('family', 'Family', '{}'),
+    ('fantasy', 'Fantasy', '{}'),
+    ('history', 'History', '{historical}'),
+    ('horror', 'Horror', '{}'),
+    ('musical', 'Musical', '{music}'),
+    ('mystery', 'Mystery', '{}'),
+    ('romance', 'Romance', '{romantic}'),
+    ('sci-fi', 'Science Fiction', '{science-fiction,scifi}'),
+    ('thriller', 'Thriller', '{}'),
+    ('war', 'War', '{}'),
+    ('western', 'Western', '{}')
+) AS seed(slug, name, aliases)
+WHERE NOT EXISTS (
+    SELECT 1
+    FROM genres
+    WHERE genres.slug = seed.slug
+       OR genres.slug = ANY(seed.aliases)
+       OR seed.slug = ANY(genres.aliases)
+       OR seed.aliases && genres.aliases
+);